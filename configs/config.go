@@ -32,6 +32,54 @@ type Config struct {
 		Insecure bool
 	}
 	DryRun bool
+	// Zones the webhook manages; dns names are split into host and domain on the longest matching zone
+	// and names outside of all zones are rejected. All names are managed when empty.
+	Zones []string
+	// OwnershipMode is `all` to expose every host override to external-dns or `managed` to expose
+	// and change only the records created by the webhook with the same owner id
+	OwnershipMode string
+	// ValidationMode is `strict` to refuse a whole change batch with any invalid endpoint or `lenient`
+	// to skip invalid endpoints, still apply the valid ones and report the skipped ones afterwards
+	ValidationMode string
+	// OwnerID identifies this instance in the metadata of the records it creates; in managed ownership
+	// mode records of other owners are neither exposed nor changed
+	OwnerID string
+	// Safety limits refuse change batches that touch too much at once; zero disables a limit
+	Safety struct {
+		MaxDeletions     int
+		MaxChangePercent int
+		// ProtectedNames are dns names or glob patterns (e.g. `*.example.com`) that are never changed
+		ProtectedNames []string
+	}
+	// DomainFilters are advertised to external-dns on negotiation and enforced on every change
+	DomainFilters struct {
+		// Filters are domains like `example.com` (the domain and its subdomains) or `.example.com` (subdomains only)
+		Filters []string
+		// DeriveFromUnbound adds the domains that already exist in pfsense to the filters; a new domain cannot be added then
+		DeriveFromUnbound bool
+	}
+	// NamePolicy limits the managed dns names with regular expressions, names outside of the policy
+	// are dropped on adjustment, rejected on changes and not reported to external-dns
+	NamePolicy struct {
+		// Include are patterns of which a name has to match at least one; every name is included when empty
+		Include []string
+		// Exclude are patterns of which a name must not match any
+		Exclude []string
+	}
+	// Quarantine holds the host overrides and custom options records whose webhook metadata cannot be read
+	Quarantine struct {
+		// RepairEnabled serves `POST /quarantine/repair` on the actuator port, which has no authentication
+		RepairEnabled bool
+	}
+	// Audit appends every change applied to pfsense to a json lines file
+	Audit struct {
+		Enabled bool
+		Path    string
+		// MaxSize is the size in bytes after which the file is rotated
+		MaxSize int64
+		// MaxFiles is the number of rotated files kept next to the current one
+		MaxFiles int
+	}
 }
 
 type URL url.URL
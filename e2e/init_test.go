@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -54,6 +55,8 @@ func startApp() func() error {
 	actuatorPort := testdata.GetFreePort()
 	os.Setenv("APP_ACTUATOR_PORT", strconv.Itoa(actuatorPort))
 
+	os.Setenv("APP_DOMAINFILTERS_FILTERS", strings.Join(testdata.Cfg.App.DomainFilters, ","))
+
 	app, err := pkg.NewApp()
 	if err != nil {
 		slog.Error("failed to start app", "err", err)
@@ -1,10 +1,13 @@
 package e2e
 
 import (
+	"encoding/json"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/slamdev/external-dns-pfsense-webhook/api/externaldnsapi"
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
 	"github.com/slamdev/external-dns-pfsense-webhook/testdata"
 	"github.com/stretchr/testify/require"
 )
@@ -19,7 +22,7 @@ func Test_should_verify_webhook_endpoints(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, negotiateResp.StatusCode(), string(negotiateResp.Body))
 	negotiate := negotiateResp.ApplicationexternalDnsWebhookJSONVersion1200
-	require.Empty(t, negotiate.Filters)
+	require.ElementsMatch(t, testdata.Cfg.App.DomainFilters, negotiate.Include)
 
 	recordsResp, err := apiClient.GetRecordsWithResponse(ctx)
 	require.NoError(t, err)
@@ -43,3 +46,82 @@ func Test_should_verify_webhook_endpoints(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, http.StatusNoContent, setRecordsResp.StatusCode(), string(setRecordsResp.Body))
 }
+
+func Test_should_plan_changes_without_applying_them(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	apiClient := testdata.CreateWebhookClient(t)
+
+	endpoint := testdata.RndEndpoint()
+	changes := externaldnsapi.Changes{
+		Create: &[]externaldnsapi.Endpoint{endpoint},
+	}
+	planResp, err := apiClient.PlanRecordsWithResponse(ctx, changes)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, planResp.StatusCode(), string(planResp.Body))
+	plan := planResp.JSON200
+	require.Len(t, plan.HostsAdded, 1)
+	require.Empty(t, plan.HostsRemoved)
+	require.NotEmpty(t, plan.Reloads)
+
+	recordsResp, err := apiClient.GetRecordsWithResponse(ctx)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, recordsResp.StatusCode(), string(recordsResp.Body))
+	for _, record := range *recordsResp.ApplicationexternalDnsWebhookJSONVersion1200 {
+		require.NotEqual(t, *endpoint.DnsName, *record.DnsName)
+	}
+}
+
+func Test_should_narrow_external_dns_to_domain_filters(t *testing.T) {
+	t.Parallel()
+
+	ctx := t.Context()
+	apiClient := testdata.CreateWebhookClient(t)
+
+	negotiateResp, err := apiClient.NegotiateWithResponse(ctx)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, negotiateResp.StatusCode(), string(negotiateResp.Body))
+
+	// external-dns decodes the negotiation response into its domain filter, which reads include and exclude only
+	var domainFilter struct {
+		Include []string `json:"include"`
+		Exclude []string `json:"exclude"`
+	}
+	require.NoError(t, json.Unmarshal(negotiateResp.Body, &domainFilter))
+	require.ElementsMatch(t, testdata.Cfg.App.DomainFilters, domainFilter.Include)
+	require.Empty(t, domainFilter.Exclude)
+	if len(domainFilter.Include) == 0 {
+		t.Skip("the app advertises no domain filters, external-dns manages every name")
+	}
+
+	inside := testdata.RndEndpoint()
+	require.True(t, matchesDomainFilter(*inside.DnsName, domainFilter.Include), *inside.DnsName)
+	outside := testdata.RndEndpoint(func(endpoint *externaldnsapi.Endpoint) {
+		endpoint.DnsName = integration.ToPointer(testdata.RndName() + ".example.org")
+	})
+	require.False(t, matchesDomainFilter(*outside.DnsName, domainFilter.Include), *outside.DnsName)
+
+	// external-dns never sends a name outside of its domain filter, and the webhook refuses it when sent anyway
+	setRecordsResp, err := apiClient.SetRecordsWithApplicationExternalDNSWebhookPlusJSONVersion1BodyWithResponse(ctx, externaldnsapi.Changes{
+		Create: &[]externaldnsapi.Endpoint{outside},
+	})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, setRecordsResp.StatusCode(), string(setRecordsResp.Body))
+}
+
+// matchesDomainFilter matches a name the way the domain filter of external-dns does: `example.com` covers the domain
+// and its subdomains, `.example.com` covers the subdomains only.
+func matchesDomainFilter(name string, include []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, filter := range include {
+		filter = strings.ToLower(strings.TrimSuffix(filter, "."))
+		if strings.HasPrefix(filter, ".") && strings.HasSuffix(name, filter) {
+			return true
+		}
+		if name == filter || strings.HasSuffix(name, "."+filter) {
+			return true
+		}
+	}
+	return false
+}
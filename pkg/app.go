@@ -4,10 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/url"
 
-	"alexejk.io/go-xmlrpc"
 	"github.com/slamdev/external-dns-pfsense-webhook/api/externaldnsapi"
 	"github.com/slamdev/external-dns-pfsense-webhook/pkg/business"
 	"github.com/slamdev/external-dns-pfsense-webhook/pkg/business/svc"
@@ -32,7 +32,10 @@ type app struct {
 	traceProvider  *trace.TracerProvider
 	metricProvider *metric.MeterProvider
 	healthChecker  healthlib.Checker
-	pfsenseClient  *xmlrpc.Client
+	pfsenseClient  *integration.XMLRPCClient
+	pfsenseService svc.PfsenseService
+	namePolicy     svc.NamePolicy
+	auditLog       svc.AuditLog
 }
 
 func NewApp() (App, error) {
@@ -53,16 +56,26 @@ func NewApp() (App, error) {
 
 	app.configureHealthChecker()
 
-	pfsenseSvc := svc.NewPfsenseService(app.pfsenseClient, app.config.DryRun)
+	if err := app.configureAuditLog(); err != nil {
+		return nil, fmt.Errorf("failed to configure audit log; %w", err)
+	}
+
+	if err := app.configureNamePolicy(); err != nil {
+		return nil, fmt.Errorf("failed to configure name policy; %w", err)
+	}
 
-	webhookController := business.NewController(pfsenseSvc)
+	if err := app.configurePfsenseService(); err != nil {
+		return nil, fmt.Errorf("failed to configure pfsense service; %w", err)
+	}
+
+	webhookController := business.NewController(app.pfsenseService)
 	webhookMux := http.NewServeMux()
 	if err := app.injectWebookHandler(webhookMux, webhookController); err != nil {
 		return nil, fmt.Errorf("failed to create webhook handler; %w", err)
 	}
 
 	app.webhookServer = integration.NewHTTPServer(app.config.HTTP.Port, integration.APIHandler(webhookMux))
-	app.actuatorServer = integration.NewHTTPServer(app.config.Actuator.Port, integration.TelemetryHandler(app.healthChecker))
+	app.actuatorServer = integration.NewHTTPServer(app.config.Actuator.Port, integration.TelemetryHandler(app.healthChecker, business.ActuatorHandlers(app.auditLog, app.pfsenseService, app.config.Quarantine.RepairEnabled)))
 	return &app, nil
 }
 
@@ -128,11 +141,55 @@ func (a *app) configureTelemetry(ctx context.Context) error {
 
 func (a *app) configurePfsenseClient() error {
 	pfsenseURL := url.URL(a.config.Pfsense.URL)
-	pfsenseClient, err := integration.CreatePfsenseClient(pfsenseURL.String(), a.config.Pfsense.Username, a.config.Pfsense.Password, a.config.Pfsense.Insecure)
+	a.pfsenseClient = integration.CreatePfsenseClient(pfsenseURL.String(), a.config.Pfsense.Username, a.config.Pfsense.Password, a.config.Pfsense.Insecure)
+	return nil
+}
+
+func (a *app) configureAuditLog() error {
+	if !a.config.Audit.Enabled {
+		a.auditLog = svc.NewNoopAuditLog()
+		return nil
+	}
+	auditLog, err := svc.NewFileAuditLog(a.config.Audit.Path, a.config.Audit.MaxSize, a.config.Audit.MaxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to create audit log; %w", err)
+	}
+	a.auditLog = auditLog
+	return nil
+}
+
+func (a *app) configureNamePolicy() error {
+	namePolicy, err := svc.NewNamePolicy(a.config.NamePolicy.Include, a.config.NamePolicy.Exclude)
 	if err != nil {
-		return fmt.Errorf("failed to create pfsense client; %w", err)
+		return fmt.Errorf("failed to create name policy; %w", err)
 	}
-	a.pfsenseClient = pfsenseClient
+	a.namePolicy = namePolicy
+	return nil
+}
+
+func (a *app) configurePfsenseService() error {
+	pfsenseService, err := svc.NewPfsenseService(a.pfsenseClient, svc.PfsenseOptions{
+		DryRun:         a.config.DryRun,
+		Zones:          a.config.Zones,
+		OwnershipMode:  a.config.OwnershipMode,
+		ValidationMode: a.config.ValidationMode,
+		OwnerID:        a.config.OwnerID,
+		SafetyLimits: svc.SafetyLimits{
+			MaxDeletions:     a.config.Safety.MaxDeletions,
+			MaxChangePercent: a.config.Safety.MaxChangePercent,
+			ProtectedNames:   a.config.Safety.ProtectedNames,
+		},
+		DomainFilters: svc.DomainFilters{
+			Filters:           a.config.DomainFilters.Filters,
+			DeriveFromUnbound: a.config.DomainFilters.DeriveFromUnbound,
+		},
+		NamePolicy: a.namePolicy,
+		Audit:      a.auditLog,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create pfsense service; %w", err)
+	}
+	a.pfsenseService = pfsenseService
 	return nil
 }
 
@@ -141,6 +198,7 @@ func (a *app) Start() error {
 		a.actuatorServer.Start,
 		a.webhookServer.Start,
 		func() error { a.healthChecker.Start(); return nil },
+		a.migrateRecords,
 	}
 	done := make(chan error, len(starters))
 	for i := range starters {
@@ -159,6 +217,15 @@ func (a *app) Start() error {
 	return nil
 }
 
+// migrateRecords upgrades records stored in a legacy form; a failure is not fatal
+// since the same migration happens on every change applied to pfsense.
+func (a *app) migrateRecords() error {
+	if err := a.pfsenseService.MigrateRecords(context.Background()); err != nil {
+		slog.Error("failed to migrate legacy records", "err", err)
+	}
+	return nil
+}
+
 func (a *app) Stop() error {
 	a.healthChecker.Stop()
 	ctx := context.Background()
@@ -0,0 +1,112 @@
+package business
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/business/svc"
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// ActuatorHandlers returns the handlers served on the actuator port next to health and metrics.
+// The port has no authentication, so the handlers that change pfsense are served only when enabled.
+func ActuatorHandlers(auditLog svc.AuditLog, pfsenseService svc.PfsenseService, quarantineRepairEnabled bool) map[string]http.Handler {
+	handlers := map[string]http.Handler{
+		"GET /audit":        auditHandler(auditLog),
+		"GET /dryrun/diffs": dryRunDiffsHandler(pfsenseService),
+		"GET /quarantine":   quarantineHandler(pfsenseService),
+	}
+	if quarantineRepairEnabled {
+		// repairing is an explicit action, quarantined records are never rewritten on their own
+		handlers["POST /quarantine/repair"] = quarantineRepairHandler(pfsenseService)
+	}
+	return handlers
+}
+
+// auditHandler returns the latest audit entries, the newest first; `?limit=` sets how many.
+func auditHandler(auditLog svc.AuditLog) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultAuditLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > maxAuditLimit {
+				integration.HandleHTTPBadRequest(w, r, integration.NewValidationError(fmt.Sprintf("limit should be a number within [1 %d], got %+v", maxAuditLimit, value)))
+				return
+			}
+			limit = parsed
+		}
+		entries, err := auditLog.Recent(limit)
+		if err != nil {
+			integration.HandleHTTPServerError(w, r, err)
+			return
+		}
+		writeJSON(w, r, entries)
+	})
+}
+
+// dryRunDiffsHandler returns the diffs of the latest dry run changes, the newest first, as plain text
+// so they read like `diff -u` output; `?format=json` returns them as json.
+func dryRunDiffsHandler(pfsenseService svc.PfsenseService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		diffs := pfsenseService.RecentDryRunDiffs()
+		if r.URL.Query().Get("format") == "json" {
+			writeJSON(w, r, diffs)
+			return
+		}
+		var builder strings.Builder
+		for _, diff := range diffs {
+			fmt.Fprintf(&builder, "# %s", diff.Time.Format(time.RFC3339))
+			if diff.TraceID != "" {
+				fmt.Fprintf(&builder, " trace %s", diff.TraceID)
+			}
+			fmt.Fprintf(&builder, "\n%s%s\n", diff.Hosts, diff.XML)
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if _, err := w.Write([]byte(builder.String())); err != nil {
+			slog.ErrorContext(r.Context(), "failed to write response", "err", err)
+		}
+	})
+}
+
+// quarantineHandler returns the host overrides and custom options records that are not reported to external-dns because they cannot be read as records.
+func quarantineHandler(pfsenseService svc.PfsenseService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		quarantined, err := pfsenseService.QuarantinedRecords(r.Context())
+		if err != nil {
+			integration.HandleHTTPServerError(w, r, err)
+			return
+		}
+		writeJSON(w, r, quarantined)
+	})
+}
+
+// quarantineRepairHandler rewrites the metadata of the quarantined host overrides and returns the repaired ones.
+func quarantineRepairHandler(pfsenseService svc.PfsenseService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repaired, err := pfsenseService.RepairQuarantinedRecords(r.Context())
+		if err != nil {
+			integration.HandleHTTPCommonError(w, r, err)
+			return
+		}
+		writeJSON(w, r, repaired)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.ErrorContext(r.Context(), "failed to write response", "err", err)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
 
 	"github.com/slamdev/external-dns-pfsense-webhook/api/externaldnsapi"
 	"github.com/slamdev/external-dns-pfsense-webhook/pkg/business/svc"
@@ -20,9 +22,16 @@ func NewController(pfsenseService svc.PfsenseService) externaldnsapi.StrictServe
 	}
 }
 
-func (c *controller) Negotiate(_ context.Context, _ externaldnsapi.NegotiateRequestObject) (externaldnsapi.NegotiateResponseObject, error) {
+func (c *controller) Negotiate(ctx context.Context, _ externaldnsapi.NegotiateRequestObject) (externaldnsapi.NegotiateResponseObject, error) {
+	filters, err := c.pfsenseService.DomainFilters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve domain filters; %w", err)
+	}
+	if filters == nil {
+		filters = []string{}
+	}
 	return externaldnsapi.Negotiate200ApplicationExternalDNSWebhookPlusJSONVersion1Response{
-		Filters: []string{},
+		Include: filters,
 	}, nil
 }
 
@@ -39,40 +48,93 @@ func (c *controller) GetRecords(ctx context.Context, _ externaldnsapi.GetRecords
 }
 
 func (c *controller) SetRecords(ctx context.Context, request externaldnsapi.SetRecordsRequestObject) (externaldnsapi.SetRecordsResponseObject, error) {
-	var hostsToCreate, hostsToUpdate, hostsToDelete []svc.UnboundEndpoint
-	var err error
-
 	slog.InfoContext(ctx, "external-dns wants to set records", slog.String("records", integration.ToUnsafeJSONString(request.Body)))
 
-	if request.Body.Create != nil {
-		hostsToCreate, err = integration.MapSliceErr(*request.Body.Create, c.asUnboundEndpoint)
+	hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete, err := c.asUnboundChanges(*request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.pfsenseService.ApplyChanges(ctx, hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete); err != nil {
+		return nil, fmt.Errorf("failed to apply unbound hosts changes; %w", err)
+	}
+	return externaldnsapi.SetRecords204Response{}, nil
+}
+
+func (c *controller) PlanRecords(ctx context.Context, request externaldnsapi.PlanRecordsRequestObject) (externaldnsapi.PlanRecordsResponseObject, error) {
+	hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete, err := c.asUnboundChanges(*request.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := c.pfsenseService.PlanChanges(ctx, hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete)
+	if err != nil {
+		return nil, fmt.Errorf("failed to plan unbound hosts changes; %w", err)
+	}
+	skipped, err := integration.MapSliceErr(plan.Skipped, c.asAPISkippedEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map skipped endpoints; %w", err)
+	}
+	return externaldnsapi.PlanRecords200JSONResponse{
+		HostsAdded:           integration.MapSlice(plan.HostsAdded, c.asAPIHostOverride),
+		HostsModified:        integration.MapSlice(plan.HostsModified, c.asAPIHostOverrideModification),
+		HostsRemoved:         integration.MapSlice(plan.HostsRemoved, c.asAPIHostOverride),
+		CustomOptionsAdded:   plan.CustomOptionsAdded,
+		CustomOptionsRemoved: plan.CustomOptionsRemoved,
+		Reloads:              plan.Reloads,
+		Skipped:              skipped,
+	}, nil
+}
+
+// asUnboundChanges maps the changes; updateOld is paired with updateNew by index, as external-dns plans them.
+func (c *controller) asUnboundChanges(changes externaldnsapi.Changes) ([]svc.UnboundEndpoint, []svc.UnboundEndpoint, []svc.UnboundEndpoint, []svc.UnboundEndpoint, error) {
+	var hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete []svc.UnboundEndpoint
+	var err error
+
+	if changes.Create != nil {
+		hostsToCreate, err = integration.MapSliceErr(*changes.Create, c.asUnboundEndpoint)
 		if err != nil {
-			return nil, integration.NewValidationError(err.Error())
+			return nil, nil, nil, nil, integration.NewValidationError(err.Error())
 		}
 	}
 
-	if request.Body.UpdateNew != nil {
-		hostsToUpdate, err = integration.MapSliceErr(*request.Body.UpdateNew, c.asUnboundEndpoint)
+	if changes.UpdateOld != nil {
+		hostsToUpdateOld, err = integration.MapSliceErr(*changes.UpdateOld, c.asUnboundEndpoint)
 		if err != nil {
-			return nil, integration.NewValidationError(err.Error())
+			return nil, nil, nil, nil, integration.NewValidationError(err.Error())
 		}
 	}
 
-	if request.Body.Delete != nil {
-		hostsToDelete, err = integration.MapSliceErr(*request.Body.Delete, c.asUnboundEndpoint)
+	if changes.UpdateNew != nil {
+		hostsToUpdate, err = integration.MapSliceErr(*changes.UpdateNew, c.asUnboundEndpoint)
 		if err != nil {
-			return nil, integration.NewValidationError(err.Error())
+			return nil, nil, nil, nil, integration.NewValidationError(err.Error())
 		}
 	}
 
-	if err := c.pfsenseService.ApplyChanges(ctx, hostsToCreate, hostsToUpdate, hostsToDelete); err != nil {
-		return nil, fmt.Errorf("failed to apply unbound hosts changes; %w", err)
+	if changes.Delete != nil {
+		hostsToDelete, err = integration.MapSliceErr(*changes.Delete, c.asUnboundEndpoint)
+		if err != nil {
+			return nil, nil, nil, nil, integration.NewValidationError(err.Error())
+		}
 	}
-	return externaldnsapi.SetRecords204Response{}, nil
+	return hostsToCreate, hostsToUpdateOld, hostsToUpdate, hostsToDelete, nil
 }
 
-func (c *controller) AdjustRecords(_ context.Context, request externaldnsapi.AdjustRecordsRequestObject) (externaldnsapi.AdjustRecordsResponseObject, error) {
-	return externaldnsapi.AdjustRecords200ApplicationExternalDNSWebhookPlusJSONVersion1Response(*request.Body), nil
+func (c *controller) AdjustRecords(ctx context.Context, request externaldnsapi.AdjustRecordsRequestObject) (externaldnsapi.AdjustRecordsResponseObject, error) {
+	unboundEndpoints, err := integration.MapSliceErr(*request.Body, c.asUnboundEndpoint)
+	if err != nil {
+		return nil, integration.NewValidationError(err.Error())
+	}
+	adjusted, err := c.pfsenseService.AdjustEndpoints(ctx, unboundEndpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to adjust unbound endpoints; %w", err)
+	}
+	externalDNSEndpoints, err := integration.MapSliceErr(adjusted, c.asExternalDNSEndpoint)
+	if err != nil {
+		return nil, integration.NewValidationError(err.Error())
+	}
+	return externaldnsapi.AdjustRecords200ApplicationExternalDNSWebhookPlusJSONVersion1Response(externalDNSEndpoints), nil
 }
 
 func (c *controller) asExternalDNSEndpoint(endpoint svc.UnboundEndpoint) (externaldnsapi.Endpoint, error) {
@@ -80,6 +142,8 @@ func (c *controller) asExternalDNSEndpoint(endpoint svc.UnboundEndpoint) (extern
 		DnsName:          &endpoint.DNSName,
 		Targets:          &endpoint.Targets,
 		RecordType:       &endpoint.RecordType,
+		RecordTTL:        c.fromRecordTTL(endpoint.RecordTTL),
+		SetIdentifier:    c.fromSetIdentifier(endpoint.SetIdentifier),
 		Labels:           endpoint.Labels,
 		ProviderSpecific: c.fromProviderSpecificMap(endpoint.ProviderSpecific),
 	}, nil
@@ -90,11 +154,56 @@ func (c *controller) asUnboundEndpoint(endpoint externaldnsapi.Endpoint) (svc.Un
 		DNSName:          integration.FromPtr(endpoint.DnsName, ""),
 		Targets:          integration.FromPtr(endpoint.Targets, []string{}),
 		RecordType:       integration.FromPtr(endpoint.RecordType, ""),
+		RecordTTL:        integration.FromPtr(endpoint.RecordTTL, 0),
+		SetIdentifier:    integration.FromPtr(endpoint.SetIdentifier, ""),
 		Labels:           endpoint.Labels,
 		ProviderSpecific: c.toProviderSpecificMap(endpoint.ProviderSpecific),
 	}, nil
 }
 
+func (c *controller) asAPIHostOverride(host svc.HostOverride) externaldnsapi.HostOverride {
+	return externaldnsapi.HostOverride{
+		Host:   host.Host,
+		Domain: host.Domain,
+		Ip:     host.Ip,
+		Descr:  host.Descr,
+	}
+}
+
+func (c *controller) asAPIHostOverrideModification(modification svc.HostOverrideModification) externaldnsapi.HostOverrideModification {
+	return externaldnsapi.HostOverrideModification{
+		Before: c.asAPIHostOverride(modification.Before),
+		After:  c.asAPIHostOverride(modification.After),
+	}
+}
+
+// fromRecordTTL omits the default ttl, so external-dns treats it as not configured.
+func (c *controller) asAPISkippedEndpoint(skipped svc.SkippedEndpoint) (externaldnsapi.SkippedEndpoint, error) {
+	endpoint, err := c.asExternalDNSEndpoint(skipped.Endpoint)
+	if err != nil {
+		return externaldnsapi.SkippedEndpoint{}, err
+	}
+	return externaldnsapi.SkippedEndpoint{
+		Name:     skipped.Name,
+		Endpoint: endpoint,
+		Reason:   skipped.Reason,
+	}, nil
+}
+
+func (c *controller) fromRecordTTL(ttl int64) *int64 {
+	if ttl == 0 {
+		return nil
+	}
+	return &ttl
+}
+
+func (c *controller) fromSetIdentifier(setIdentifier string) *string {
+	if setIdentifier == "" {
+		return nil
+	}
+	return &setIdentifier
+}
+
 func (c *controller) toProviderSpecificMap(values []externaldnsapi.ProviderSpecificProperty) map[string]string {
 	result := make(map[string]string)
 	for _, v := range values {
@@ -105,9 +214,11 @@ func (c *controller) toProviderSpecificMap(values []externaldnsapi.ProviderSpeci
 	return result
 }
 
+// fromProviderSpecificMap returns the properties sorted by name, so the same endpoint is always reported the same way.
 func (c *controller) fromProviderSpecificMap(values map[string]string) []externaldnsapi.ProviderSpecificProperty {
 	result := make([]externaldnsapi.ProviderSpecificProperty, 0, len(values))
-	for k, v := range values {
+	for _, k := range slices.Sorted(maps.Keys(values)) {
+		v := values[k]
 		result = append(result, externaldnsapi.ProviderSpecificProperty{
 			Name:  &k,
 			Value: &v,
@@ -0,0 +1,90 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+)
+
+// AdjustEndpoints returns the endpoints the way they would be stored, so external-dns plans against the very
+// same records it reads back and does not see the same diff on every loop. Endpoints that would be rejected,
+// e.g. of unsupported types, outside of managed zones, the domain filters or the name policy, are dropped.
+func (s *pfsenseService) AdjustEndpoints(ctx context.Context, endpoints []UnboundEndpoint) ([]UnboundEndpoint, error) {
+	if len(endpoints) == 0 {
+		return []UnboundEndpoint{}, nil
+	}
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	stored, err := s.storedEndpoints(section)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := s.resolveDomainFilters(section)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve domain filters; %w", err)
+	}
+	adjusted := make([]UnboundEndpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		endpoint = s.normalizeEndpoint(endpoint)
+		if reason := s.rejectionReason(endpoint, filters); reason != "" {
+			slog.InfoContext(ctx, "dropping endpoint that cannot be stored", slog.String("dnsName", endpoint.DNSName),
+				slog.String("recordType", endpoint.RecordType), slog.String("reason", reason))
+			continue
+		}
+		if existing, ok := stored[endpoint.key()]; ok {
+			endpoint.ProviderSpecific = s.withStoredProviderSpecific(endpoint.ProviderSpecific, existing.ProviderSpecific)
+		}
+		adjusted = append(adjusted, endpoint)
+	}
+	return adjusted, nil
+}
+
+// storedEndpoints returns the records reported to external-dns by their key.
+func (s *pfsenseService) storedEndpoints(section unbound) (map[recordKey]UnboundEndpoint, error) {
+	records, err := s.readRecords(section)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unbound records; %w", err)
+	}
+	stored := make(map[recordKey]UnboundEndpoint, len(records))
+	for _, record := range records {
+		if s.exposed(record) {
+			stored[record.endpoint.key()] = record.endpoint
+		}
+	}
+	return stored, nil
+}
+
+// normalizeEndpoint spells the endpoint the way it is read back from pfsense.
+func (s *pfsenseService) normalizeEndpoint(endpoint UnboundEndpoint) UnboundEndpoint {
+	endpoint.DNSName = strings.ToLower(strings.TrimSuffix(endpoint.DNSName, "."))
+	endpoint.RecordType = strings.ToUpper(endpoint.RecordType)
+	endpoint.Targets = s.sortTargets(endpoint.Targets)
+	return endpoint
+}
+
+// rejectionReason returns why the endpoint would be rejected by ApplyChanges, or an empty string when it can be stored.
+// The filters are the resolved domain filters, see resolveDomainFilters.
+func (s *pfsenseService) rejectionReason(endpoint UnboundEndpoint, filters []string) string {
+	if reason := s.scopeReason(endpoint.DNSName, filters); reason != "" {
+		return reason
+	}
+	if err := s.validateEndpoints([]UnboundEndpoint{endpoint}); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// withStoredProviderSpecific fills the provider specific properties that are not set with the stored ones,
+// so properties external-dns does not know about are not reported as removed.
+func (s *pfsenseService) withStoredProviderSpecific(requested map[string]string, stored map[string]string) map[string]string {
+	if len(stored) == 0 {
+		return requested
+	}
+	merged := maps.Clone(stored)
+	maps.Copy(merged, requested)
+	return merged
+}
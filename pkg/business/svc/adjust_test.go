@@ -0,0 +1,59 @@
+package svc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_adjust_endpoints_to_how_they_are_stored(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{Zones: []string{"example.com"}})
+
+	adjusted, err := s.AdjustEndpoints(t.Context(), []UnboundEndpoint{
+		{DNSName: "APP.Example.com.", RecordType: "a", Targets: []string{"10.0.0.11", "10.0.0.10"}},
+		{DNSName: "*.example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.12"}},
+		{DNSName: "ns.example.com", RecordType: "NS", Targets: []string{"ns1.example.com"}},
+		{DNSName: "nas.home.arpa", RecordType: recordTypeA, Targets: []string{"192.168.1.5"}},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []UnboundEndpoint{
+		{DNSName: "app.example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.10", "10.0.0.11"}},
+		{DNSName: "*.example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.12"}},
+	}, adjusted)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_drop_endpoints_outside_of_domain_filters_on_adjustment(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{DomainFilters: DomainFilters{Filters: []string{".example.com"}}})
+
+	adjusted, err := s.AdjustEndpoints(t.Context(), []UnboundEndpoint{
+		{DNSName: "app.example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.10"}},
+		{DNSName: "example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.11"}},
+		{DNSName: "app.example.org", RecordType: recordTypeA, Targets: []string{"10.0.0.12"}},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, []UnboundEndpoint{
+		{DNSName: "app.example.com", RecordType: recordTypeA, Targets: []string{"10.0.0.10"}},
+	}, adjusted)
+}
+
+func Test_should_fill_provider_specific_properties_from_stored_ones(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	merged := s.withStoredProviderSpecific(map[string]string{"a": "requested"}, map[string]string{"a": "stored", "b": "stored"})
+	require.Equal(t, map[string]string{"a": "requested", "b": "stored"}, merged)
+}
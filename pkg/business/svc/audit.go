@@ -0,0 +1,225 @@
+package svc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+const (
+	auditOutcomeApplied = "applied"
+	auditOutcomeFailed  = "failed"
+	// auditOutcomeSkipped is the outcome of changes that are not applied in dry run
+	auditOutcomeSkipped = "skipped"
+)
+
+// AuditEntry is a single change of a record applied to pfsense.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	Action        string    `json:"action"`
+	DNSName       string    `json:"dnsName"`
+	RecordType    string    `json:"recordType"`
+	SetIdentifier string    `json:"setIdentifier,omitempty"`
+	OldTargets    []string  `json:"oldTargets,omitempty"`
+	NewTargets    []string  `json:"newTargets,omitempty"`
+	TraceID       string    `json:"traceId,omitempty"`
+	DryRun        bool      `json:"dryRun"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// AuditLog keeps the history of the changes applied to pfsense.
+type AuditLog interface {
+	// Record appends the entries; a failure is logged but never fails the change itself
+	Record(ctx context.Context, entries []AuditEntry)
+	// Recent returns up to limit latest entries, the newest first
+	Recent(limit int) ([]AuditEntry, error)
+}
+
+type noopAuditLog struct{}
+
+func NewNoopAuditLog() AuditLog {
+	return noopAuditLog{}
+}
+
+func (noopAuditLog) Record(_ context.Context, _ []AuditEntry) {}
+
+func (noopAuditLog) Recent(_ int) ([]AuditEntry, error) {
+	return []AuditEntry{}, nil
+}
+
+// fileAuditLog appends entries as json lines to a file. The file is rotated once it grows over maxSize:
+// `audit.jsonl` becomes `audit.jsonl.1`, `audit.jsonl.1` becomes `audit.jsonl.2` and so on, up to maxFiles rotated files.
+type fileAuditLog struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+}
+
+func NewFileAuditLog(path string, maxSize int64, maxFiles int) (AuditLog, error) {
+	if path == "" {
+		return nil, errors.New("audit log path is required")
+	}
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("audit log max size should be positive, got %+v", maxSize)
+	}
+	if maxFiles < 0 {
+		return nil, fmt.Errorf("audit log max files should not be negative, got %+v", maxFiles)
+	}
+	return &fileAuditLog{path: path, maxSize: maxSize, maxFiles: maxFiles}, nil
+}
+
+func (l *fileAuditLog) Record(ctx context.Context, entries []AuditEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	if err := l.append(entries); err != nil {
+		slog.ErrorContext(ctx, "failed to write audit log", slog.String("path", l.path), slog.Any("err", err))
+	}
+}
+
+func (l *fileAuditLog) append(entries []AuditEntry) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to marshal audit entry; %w", err)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.rotate(int64(buf.Len())); err != nil {
+		return fmt.Errorf("failed to rotate audit log; %w", err)
+	}
+	//nolint:gosec
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log; %w", err)
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to append audit log; %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log; %w", err)
+	}
+	return nil
+}
+
+// rotate shifts the rotated files when the log cannot take the next write.
+func (l *fileAuditLog) rotate(nextWrite int64) error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat audit log; %w", err)
+	}
+	if info.Size() == 0 || info.Size()+nextWrite <= l.maxSize {
+		return nil
+	}
+	if l.maxFiles == 0 {
+		if err := os.Remove(l.path); err != nil {
+			return fmt.Errorf("failed to remove audit log; %w", err)
+		}
+		return nil
+	}
+	for i := l.maxFiles - 1; i >= 0; i-- {
+		from := l.rotatedPath(i)
+		if err := os.Rename(from, l.rotatedPath(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rename %s; %w", from, err)
+		}
+	}
+	return nil
+}
+
+func (l *fileAuditLog) rotatedPath(index int) string {
+	if index == 0 {
+		return l.path
+	}
+	return fmt.Sprintf("%s.%d", l.path, index)
+}
+
+func (l *fileAuditLog) Recent(limit int) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := []AuditEntry{}
+	for i := 0; i <= l.maxFiles && len(recent) < limit; i++ {
+		entries, err := l.read(l.rotatedPath(i))
+		if err != nil {
+			return nil, err
+		}
+		slices.Reverse(entries)
+		recent = append(recent, entries[:min(len(entries), limit-len(recent))]...)
+	}
+	return recent, nil
+}
+
+func (l *fileAuditLog) read(path string) ([]AuditEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log %s; %w", path, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a line cut by a crash must not hide the rest of the log
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s; %w", path, err)
+	}
+	return entries, nil
+}
+
+func (s *pfsenseService) auditEntries(ctx context.Context, changes []recordChange, outcome string, err error) []AuditEntry {
+	traceID := integration.TraceID(ctx)
+	var errText string
+	if err != nil {
+		errText = err.Error()
+	}
+	now := time.Now().UTC()
+	return integration.MapSlice(changes, func(change recordChange) AuditEntry {
+		entry := AuditEntry{
+			Time:    now,
+			Action:  change.Action,
+			TraceID: traceID,
+			DryRun:  s.dryRun,
+			Outcome: outcome,
+			Error:   errText,
+		}
+		if change.Before != nil {
+			entry.DNSName, entry.RecordType, entry.SetIdentifier = change.Before.DNSName, change.Before.RecordType, change.Before.SetIdentifier
+			entry.OldTargets = change.Before.Targets
+		}
+		if change.After != nil {
+			entry.DNSName, entry.RecordType, entry.SetIdentifier = change.After.DNSName, change.After.RecordType, change.After.SetIdentifier
+			entry.NewTargets = change.After.Targets
+		}
+		return entry
+	})
+}
@@ -0,0 +1,37 @@
+package svc
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_rotate_audit_log_and_return_recent_entries(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	// every entry takes about a hundred bytes, so each file keeps two of them
+	auditLog, err := NewFileAuditLog(filepath.Join(dir, "audit.jsonl"), 300, 2)
+	require.NoError(t, err)
+
+	for i := range 10 {
+		auditLog.Record(t.Context(), []AuditEntry{{Action: changeActionCreate, DNSName: fmt.Sprintf("host-%d.example.com", i), Outcome: auditOutcomeApplied}})
+	}
+
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+
+	recent, err := auditLog.Recent(3)
+	require.NoError(t, err)
+	require.Len(t, recent, 3)
+	require.Equal(t, "host-9.example.com", recent[0].DNSName)
+	require.Equal(t, "host-7.example.com", recent[2].DNSName)
+
+	all, err := auditLog.Recent(100)
+	require.NoError(t, err)
+	require.Len(t, all, 6)
+}
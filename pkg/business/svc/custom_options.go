@@ -0,0 +1,385 @@
+package svc
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// Records that cannot be expressed as host overrides are rendered as unbound `local-data` entries
+// inside a block of custom options owned by the webhook. Every record in the block is preceded by
+// a comment with its metadata, which is the source of truth when the block is read back.
+// Everything outside the block belongs to the user and is written back untouched.
+const (
+	managedBlockBegin   = "# external-dns-pfsense-webhook: begin of managed records, do not edit"
+	managedBlockEnd     = "# external-dns-pfsense-webhook: end of managed records"
+	managedRecordPrefix = "# record: "
+)
+
+var domainNameLabel = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?$`)
+
+type customOptions struct {
+	// raw is the custom options as they are stored in pfsense
+	raw string
+	// before and after are the user-defined options around the managed block
+	before   string
+	after    string
+	hasBlock bool
+	records  []unboundRecord
+}
+
+func (s *pfsenseService) parseCustomOptions(raw string) (customOptions, error) {
+	options := customOptions{raw: raw}
+
+	text := s.decodeCustomOptions(raw)
+
+	begin := strings.Index(text, managedBlockBegin)
+	if begin == -1 {
+		options.before = text
+		return options, nil
+	}
+	blockLength := strings.Index(text[begin:], managedBlockEnd)
+	if blockLength == -1 {
+		return customOptions{}, errors.New("managed block in custom options has no end marker")
+	}
+	end := begin + blockLength + len(managedBlockEnd)
+	if strings.HasPrefix(text[end:], "\n") {
+		end++
+	}
+
+	for line := range strings.SplitSeq(text[begin:begin+blockLength], "\n") {
+		metadata, ok := strings.CutPrefix(strings.TrimSpace(line), managedRecordPrefix)
+		if !ok {
+			// the local data of an unreadable record is kept with it, so unbound still serves it
+			if last := len(options.records) - 1; last >= 0 && options.records[last].readErr != nil && strings.TrimSpace(line) != "" {
+				options.records[last].lines = append(options.records[last].lines, line)
+			}
+			continue
+		}
+		endpoint, meta, err := s.decodeMetadata(metadata)
+		if err != nil {
+			// a record edited by hand must not stop the rest of the block from being read
+			options.records = append(options.records, unboundRecord{readErr: fmt.Errorf("failed to read managed record %+v; %w", metadata, err), lines: []string{line}})
+			continue
+		}
+		options.records = append(options.records, unboundRecord{endpoint: endpoint, managed: true, legacy: meta.legacy, meta: meta})
+	}
+
+	options.before = text[:begin]
+	options.after = text[end:]
+	options.hasBlock = true
+	return options, nil
+}
+
+// decodeCustomOptions returns the text of custom options; pfsense keeps them base64 encoded,
+// older configs may still have them as plain text.
+func (s *pfsenseService) decodeCustomOptions(raw string) string {
+	if decoded, err := base64.StdEncoding.DecodeString(raw); err == nil {
+		return string(decoded)
+	}
+	return raw
+}
+
+func (s *pfsenseService) renderCustomOptions(options customOptions, records []unboundRecord) (string, error) {
+	if len(records) == 0 && !options.hasBlock {
+		return options.raw, nil
+	}
+
+	var block strings.Builder
+	if len(records) > 0 {
+		block.WriteString(managedBlockBegin + "\n")
+		// user-defined options may end in any clause, so the records explicitly open the server one
+		block.WriteString("server:\n")
+		readable := integration.FilterSlice(records, func(record unboundRecord) bool {
+			return record.readErr == nil
+		})
+		zones, err := s.redirectZones(options, integration.MapSlice(readable, func(record unboundRecord) UnboundEndpoint {
+			return record.endpoint
+		}))
+		if err != nil {
+			return "", fmt.Errorf("failed to collect wildcard zones; %w", err)
+		}
+		for _, zone := range zones {
+			fmt.Fprintf(&block, "local-zone: \"%s\" redirect\n", s.fqdn(zone))
+		}
+		for _, record := range records {
+			if record.readErr != nil {
+				// quarantined records are written back exactly as they were read
+				for _, line := range record.lines {
+					block.WriteString(line + "\n")
+				}
+				continue
+			}
+			endpoint := record.endpoint
+			lines, err := s.endpointToLocalData(endpoint)
+			if err != nil {
+				return "", fmt.Errorf("failed to convert endpoint %+v to local data; %w", endpoint, err)
+			}
+			block.WriteString(managedRecordPrefix + s.encodeMetadata(endpoint, record.meta) + "\n")
+			for _, line := range lines {
+				block.WriteString(line + "\n")
+			}
+		}
+		block.WriteString(managedBlockEnd + "\n")
+	}
+
+	before := options.before
+	if before != "" && block.Len() > 0 && !strings.HasSuffix(before, "\n") {
+		before += "\n"
+	}
+	text := before + block.String() + options.after
+	return base64.StdEncoding.EncodeToString([]byte(text)), nil
+}
+
+// redirectZones returns the zones that serve wildcard records. Unbound answers any name within
+// a redirect zone with the data of the zone itself, so `*.sub.example.com` is served by
+// a `sub.example.com` redirect zone and its local data.
+func (s *pfsenseService) redirectZones(options customOptions, records []UnboundEndpoint) ([]string, error) {
+	var zones []string
+	for _, endpoint := range records {
+		zone, ok := s.wildcardZone(endpoint.DNSName)
+		if !ok || slices.Contains(zones, zone) {
+			continue
+		}
+		// unbound refuses to start with duplicated local zones, so hand-written wildcards must be removed first
+		userZone := regexp.MustCompile(`local-zone:\s*"?` + regexp.QuoteMeta(zone) + `\.?"?\s`)
+		if userZone.MatchString(options.before) || userZone.MatchString(options.after) {
+			return nil, fmt.Errorf("local zone %+v is already defined in custom options outside of the managed block; dns name: %s", zone, endpoint.DNSName)
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// verifyWildcards refuses wildcard records that would shadow other records. Unbound answers every name within the
+// redirect zone of a wildcard from the data of the zone itself, so host overrides and records at or below the zone
+// would silently stop resolving. TXT records are not served from there either, but external-dns keeps its registry
+// records next to the wildcard and reads them back through the webhook only, so they are allowed. Only conflicts
+// of changed records are reported, so a conflict that is already in pfsense does not block unrelated changes.
+func (s *pfsenseService) verifyWildcards(records []unboundRecord, changes []recordChange) error {
+	changed := map[recordKey]bool{}
+	for _, change := range changes {
+		if change.After != nil {
+			changed[change.After.key()] = true
+		}
+	}
+	for _, wildcard := range records {
+		wildcardKey := wildcard.endpoint.key()
+		zone, ok := s.wildcardZone(wildcardKey.DNSName)
+		if !ok || wildcard.readErr != nil {
+			continue
+		}
+		for _, record := range records {
+			key := record.endpoint.key()
+			if record.readErr != nil || key.DNSName == wildcardKey.DNSName || key.RecordType == recordTypeTXT {
+				continue
+			}
+			if key.DNSName != zone && !strings.HasSuffix(key.DNSName, "."+zone) {
+				continue
+			}
+			if changed[wildcardKey] || changed[key] {
+				return integration.NewResourceConflictError(fmt.Sprintf("wildcard %s would shadow %s record %s, remove one of them first", wildcard.endpoint.DNSName, record.endpoint.RecordType, record.endpoint.DNSName))
+			}
+		}
+	}
+	return nil
+}
+
+// wildcardZone returns the zone of a wildcard name, e.g. `sub.example.com` for `*.sub.example.com`.
+func (s *pfsenseService) wildcardZone(name string) (string, bool) {
+	return strings.CutPrefix(name, "*.")
+}
+
+func (s *pfsenseService) endpointToLocalData(endpoint UnboundEndpoint) ([]string, error) {
+	// wildcard records are served from the apex of their redirect zone
+	name := endpoint.DNSName
+	if zone, ok := s.wildcardZone(name); ok {
+		name = zone
+	}
+	if !s.isDomainName(name) {
+		return nil, fmt.Errorf("dns name %+v is not a valid domain name", endpoint.DNSName)
+	}
+	if err := s.validateTTL(endpoint.RecordTTL); err != nil {
+		return nil, fmt.Errorf("invalid ttl for dns name %s; %w", endpoint.DNSName, err)
+	}
+
+	switch endpoint.RecordType {
+	case recordTypeA, recordTypeAAAA:
+		if len(endpoint.Targets) == 0 {
+			return nil, fmt.Errorf("at least one target is required for %s record; dns name: %s", endpoint.RecordType, endpoint.DNSName)
+		}
+		lines := make([]string, 0, len(endpoint.Targets))
+		for _, target := range s.sortTargets(endpoint.Targets) {
+			if err := s.validateAddress(endpoint.RecordType, target); err != nil {
+				return nil, fmt.Errorf("invalid target for dns name %s; %w", endpoint.DNSName, err)
+			}
+			lines = append(lines, s.localData(name, endpoint.RecordTTL, endpoint.RecordType, target))
+		}
+		return lines, nil
+	case recordTypeCNAME:
+		if len(endpoint.Targets) != 1 {
+			return nil, fmt.Errorf("only one target is supported for CNAME record, got %+v; dns name: %s", endpoint.Targets, endpoint.DNSName)
+		}
+		target := endpoint.Targets[0]
+		if !s.isDomainName(target) {
+			return nil, fmt.Errorf("target %+v is not a valid domain name; dns name: %s", target, endpoint.DNSName)
+		}
+		return []string{s.localData(name, endpoint.RecordTTL, recordTypeCNAME, s.fqdn(target))}, nil
+	case recordTypeTXT:
+		lines := make([]string, 0, len(endpoint.Targets))
+		for _, target := range s.sortTargets(endpoint.Targets) {
+			lines = append(lines, s.localData(name, endpoint.RecordTTL, recordTypeTXT, s.txtData(target)))
+		}
+		return lines, nil
+	case recordTypeMX, recordTypeSRV, recordTypePTR:
+		if endpoint.RecordType == recordTypePTR && !s.isReverseName(name) {
+			return nil, fmt.Errorf("dns name %+v of PTR record should be within in-addr.arpa or ip6.arpa", endpoint.DNSName)
+		}
+		if len(endpoint.Targets) == 0 {
+			return nil, fmt.Errorf("at least one target is required for %s record; dns name: %s", endpoint.RecordType, endpoint.DNSName)
+		}
+		lines := make([]string, 0, len(endpoint.Targets))
+		for _, target := range s.sortTargets(endpoint.Targets) {
+			data, err := s.recordData(endpoint.RecordType, target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target for dns name %s; %w", endpoint.DNSName, err)
+			}
+			lines = append(lines, s.localData(name, endpoint.RecordTTL, endpoint.RecordType, data))
+		}
+		return lines, nil
+	default:
+		return nil, fmt.Errorf("%+v record type is not supported", endpoint.RecordType)
+	}
+}
+
+// recordData converts an external-dns target to the unbound record data of the given type.
+func (s *pfsenseService) recordData(recordType string, target string) (string, error) {
+	fields := strings.Fields(target)
+	switch recordType {
+	case recordTypeMX:
+		// <preference> <exchange>
+		if len(fields) != 2 {
+			return "", fmt.Errorf("MX target should be in form of [<preference> <exchange>], got %+v", target)
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("MX preference %+v is not a 16 bit number; %w", fields[0], err)
+		}
+		if !s.isDomainName(fields[1]) {
+			return "", fmt.Errorf("MX exchange %+v is not a valid domain name", fields[1])
+		}
+		return fmt.Sprintf("%d %s", preference, s.fqdn(fields[1])), nil
+	case recordTypeSRV:
+		// <priority> <weight> <port> <target>
+		if len(fields) != 4 {
+			return "", fmt.Errorf("SRV target should be in form of [<priority> <weight> <port> <target>], got %+v", target)
+		}
+		numbers := make([]uint64, 3)
+		for i, field := range fields[:3] {
+			number, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return "", fmt.Errorf("SRV priority, weight and port should be 16 bit numbers, got %+v; %w", field, err)
+			}
+			numbers[i] = number
+		}
+		// a single dot means that the service is not available at this domain
+		srvTarget := "."
+		if fields[3] != "." {
+			if !s.isDomainName(fields[3]) {
+				return "", fmt.Errorf("SRV target %+v is not a valid domain name", fields[3])
+			}
+			srvTarget = s.fqdn(fields[3])
+		}
+		return fmt.Sprintf("%d %d %d %s", numbers[0], numbers[1], numbers[2], srvTarget), nil
+	case recordTypePTR:
+		if len(fields) != 1 || !s.isDomainName(fields[0]) {
+			return "", fmt.Errorf("PTR target %+v is not a valid domain name", target)
+		}
+		return s.fqdn(fields[0]), nil
+	default:
+		return "", fmt.Errorf("%+v record type is not supported", recordType)
+	}
+}
+
+// txtData renders a TXT target as quoted character strings of at most 255 bytes each.
+// Unbound reads local data in the zone file format, so special characters are escaped.
+func (s *pfsenseService) txtData(target string) string {
+	// external-dns sends registry records already wrapped in quotes
+	if len(target) >= 2 && strings.HasPrefix(target, `"`) && strings.HasSuffix(target, `"`) {
+		target = target[1 : len(target)-1]
+	}
+	var chunks []string
+	for len(target) > 0 || len(chunks) == 0 {
+		size := min(len(target), 255)
+		chunks = append(chunks, `"`+s.escapeTXT(target[:size])+`"`)
+		target = target[size:]
+	}
+	return strings.Join(chunks, " ")
+}
+
+func (s *pfsenseService) escapeTXT(text string) string {
+	var escaped strings.Builder
+	for i := range len(text) {
+		c := text[i]
+		switch {
+		case c == '"' || c == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c == '\'' || c < ' ' || c > '~':
+			// single quotes wrap the whole local data entry, so they are escaped as well
+			fmt.Fprintf(&escaped, "\\%03d", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
+
+func (s *pfsenseService) validateTTL(ttl int64) error {
+	if ttl < 0 || ttl > math.MaxInt32 {
+		return fmt.Errorf("ttl should be between 0 and %d, got %d", math.MaxInt32, ttl)
+	}
+	return nil
+}
+
+func (s *pfsenseService) isReverseName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	return strings.HasSuffix(name, ".in-addr.arpa") || strings.HasSuffix(name, ".ip6.arpa")
+}
+
+func (s *pfsenseService) localData(name string, ttl int64, recordType string, data string) string {
+	record := fmt.Sprintf("%s IN %s %s", s.fqdn(name), recordType, data)
+	// unbound falls back to its default ttl (3600) when the record has none
+	if ttl > 0 {
+		record = fmt.Sprintf("%s %d IN %s %s", s.fqdn(name), ttl, recordType, data)
+	}
+	// quoted TXT data cannot be nested in double quotes, so such entries are wrapped in single ones
+	if strings.Contains(record, `"`) {
+		return "local-data: '" + record + "'"
+	}
+	return `local-data: "` + record + `"`
+}
+
+func (s *pfsenseService) fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+func (s *pfsenseService) isDomainName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for label := range strings.SplitSeq(name, ".") {
+		if !domainNameLabel.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
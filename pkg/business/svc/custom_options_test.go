@@ -0,0 +1,193 @@
+package svc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_refuse_wildcard_shadowing_other_records(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	// app.example.com and www.example.com are within the redirect zone of the wildcard
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{
+		{DNSName: "*.example.com", Targets: []string{"10.0.0.1"}, RecordType: recordTypeA},
+	}, nil, nil, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+	require.Empty(t, pfsense.restores())
+
+	// the registry records of external-dns live next to the wildcard
+	require.NoError(t, s.ApplyChanges(t.Context(), []UnboundEndpoint{
+		{DNSName: "*.sub.example.com", Targets: []string{"10.0.0.1"}, RecordType: recordTypeA},
+		{DNSName: "a-prefix-wildcard.sub.example.com", Targets: []string{"\"heritage=external-dns\""}, RecordType: recordTypeTXT},
+	}, nil, nil, nil))
+}
+
+func Test_should_refuse_record_shadowed_by_existing_wildcard(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	wildcard := unboundRecord{endpoint: UnboundEndpoint{DNSName: "*.sub.example.com", Targets: []string{"10.0.0.1"}, RecordType: recordTypeA}, managed: true}
+	created := UnboundEndpoint{DNSName: "deep.host.sub.example.com", Targets: []string{"10.0.0.2"}, RecordType: recordTypeA}
+	unrelated := UnboundEndpoint{DNSName: "other.example.com", Targets: []string{"10.0.0.3"}, RecordType: recordTypeA}
+
+	err := s.verifyWildcards([]unboundRecord{wildcard, {endpoint: created, managed: true}}, []recordChange{{Action: changeActionCreate, After: &created}})
+	require.True(t, integration.IsResourceConflictError(err), err)
+
+	// a conflict already in pfsense does not block unrelated changes
+	records := []unboundRecord{wildcard, {endpoint: created, managed: true}, {endpoint: unrelated, managed: true}}
+	require.NoError(t, s.verifyWildcards(records, []recordChange{{Action: changeActionCreate, After: &unrelated}}))
+}
+
+func Test_should_keep_user_custom_options_around_managed_block(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	cname := UnboundEndpoint{DNSName: "www.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME}
+	before := "server:\nprefetch: yes\n"
+	after := "forward-zone:\nname: \"corp.example.com\"\nforward-addr: 10.0.0.53\n"
+
+	rendered, err := s.renderCustomOptions(customOptions{before: before}, []unboundRecord{{endpoint: cname, managed: true}})
+	require.NoError(t, err)
+	text := s.decodeCustomOptions(rendered)
+	require.True(t, strings.HasPrefix(text, before+managedBlockBegin+"\n"), text)
+	require.Contains(t, text, "local-data: \"www.example.com. IN CNAME app.example.com.\"")
+
+	// user text may be appended after the block by hand
+	options, err := s.parseCustomOptions(base64.StdEncoding.EncodeToString([]byte(text + after)))
+	require.NoError(t, err)
+	require.True(t, options.hasBlock)
+	require.Equal(t, before, options.before)
+	require.Equal(t, after, options.after)
+	require.Len(t, options.records, 1)
+	require.Equal(t, cname, options.records[0].endpoint)
+
+	// the block is dropped together with its last record, the user text stays
+	rendered, err = s.renderCustomOptions(options, nil)
+	require.NoError(t, err)
+	require.Equal(t, before+after, s.decodeCustomOptions(rendered))
+
+	// without a block the options are not touched at all
+	options, err = s.parseCustomOptions(before)
+	require.NoError(t, err)
+	require.False(t, options.hasBlock)
+	rendered, err = s.renderCustomOptions(options, nil)
+	require.NoError(t, err)
+	require.Equal(t, before, rendered)
+}
+
+func Test_should_refuse_managed_block_without_end_marker(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	text := "server:\nprefetch: yes\n" + managedBlockBegin + "\nserver:\nlocal-data: \"www.example.com. IN CNAME app.example.com.\"\n"
+	_, err := s.parseCustomOptions(base64.StdEncoding.EncodeToString([]byte(text)))
+	require.ErrorContains(t, err, "no end marker")
+}
+
+func Test_should_render_mx_srv_and_ptr_records_as_local_data(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	for _, tc := range []struct {
+		endpoint UnboundEndpoint
+		expected []string
+	}{
+		{
+			endpoint: UnboundEndpoint{DNSName: "example.com", Targets: []string{"20 mx2.example.com", "10 mx1.example.com."}, RecordType: recordTypeMX},
+			expected: []string{`local-data: "example.com. IN MX 10 mx1.example.com."`, `local-data: "example.com. IN MX 20 mx2.example.com."`},
+		},
+		{
+			endpoint: UnboundEndpoint{DNSName: "_ldap._tcp.example.com", Targets: []string{"0 5 389 dc.example.com"}, RecordType: recordTypeSRV},
+			expected: []string{`local-data: "_ldap._tcp.example.com. IN SRV 0 5 389 dc.example.com."`},
+		},
+		{
+			endpoint: UnboundEndpoint{DNSName: "_imap._tcp.example.com", Targets: []string{"0 0 0 ."}, RecordType: recordTypeSRV},
+			expected: []string{`local-data: "_imap._tcp.example.com. IN SRV 0 0 0 ."`},
+		},
+		{
+			endpoint: UnboundEndpoint{DNSName: "10.0.0.10.in-addr.arpa", Targets: []string{"app.example.com"}, RecordType: recordTypePTR},
+			expected: []string{`local-data: "10.0.0.10.in-addr.arpa. IN PTR app.example.com."`},
+		},
+	} {
+		lines, err := s.endpointToLocalData(tc.endpoint)
+		require.NoError(t, err, tc.endpoint.DNSName)
+		require.Equal(t, tc.expected, lines)
+	}
+
+	var validationErr *integration.ValidationError
+	for _, endpoint := range []UnboundEndpoint{
+		{DNSName: "example.com", Targets: []string{"mx1.example.com"}, RecordType: recordTypeMX},
+		{DNSName: "example.com", Targets: []string{"70000 mx1.example.com"}, RecordType: recordTypeMX},
+		{DNSName: "example.com", Targets: []string{"10 mx1..example.com"}, RecordType: recordTypeMX},
+		{DNSName: "_ldap._tcp.example.com", Targets: []string{"0 5 dc.example.com"}, RecordType: recordTypeSRV},
+		{DNSName: "_ldap._tcp.example.com", Targets: []string{"0 5 -1 dc.example.com"}, RecordType: recordTypeSRV},
+		{DNSName: "app.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypePTR},
+		{DNSName: "10.0.0.10.in-addr.arpa", Targets: []string{"app example"}, RecordType: recordTypePTR},
+		{DNSName: "10.0.0.10.in-addr.arpa", RecordType: recordTypePTR},
+	} {
+		require.ErrorAs(t, s.validateEndpoints([]UnboundEndpoint{endpoint}), &validationErr, endpoint.Targets)
+	}
+}
+
+func Test_should_escape_txt_data(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	require.Equal(t, `"heritage=external-dns,external-dns/owner=default"`, s.txtData(`"heritage=external-dns,external-dns/owner=default"`))
+	require.Equal(t, `"v=spf1 \"quoted\" back\\slash it\039s caf\195\169"`, s.txtData(`v=spf1 "quoted" back\slash it's café`))
+	require.Equal(t, `""`, s.txtData(""))
+
+	// character strings are limited to 255 bytes
+	long := strings.Repeat("a", 300)
+	require.Equal(t, `"`+long[:255]+`" "`+long[255:]+`"`, s.txtData(long))
+
+	lines, err := s.endpointToLocalData(UnboundEndpoint{DNSName: "example.com", Targets: []string{"v=spf1 -all"}, RecordType: recordTypeTXT})
+	require.NoError(t, err)
+	require.Equal(t, []string{`local-data: 'example.com. IN TXT "v=spf1 -all"'`}, lines)
+}
+
+func Test_should_migrate_txt_records_stored_as_fake_hosts(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	txt := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"\"heritage=external-dns,external-dns/owner=default\""}, RecordType: recordTypeTXT}
+	legacy, err := json.Marshal(txt)
+	require.NoError(t, err)
+	// older versions stored the TXT record as a host override pointing to 127.0.0.1
+	fake := "<value><struct><member><name>host</name><value><string>app</string></value></member>" +
+		"<member><name>domain</name><value><string>example.com</string></value></member>" +
+		"<member><name>ip</name><value><string>127.0.0.1</string></value></member>" +
+		"<member><name>descr</name><value><string>" + base64.StdEncoding.EncodeToString(legacy) + "</string></value></member></struct></value>"
+	nas := "<value><struct><member><name>host</name><value><string>nas</string>"
+	require.Contains(t, string(backup), nas)
+	pfsense := newFakePfsense(t, []byte(strings.Replace(string(backup), nas, fake+nas, 1)))
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, txt)
+
+	require.NoError(t, s.MigrateRecords(t.Context()))
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	section, ok := unboundValue(t, restores[0]).(map[string]any)
+	require.True(t, ok)
+	hosts, ok := section[unboundHostsKey].([]any)
+	require.True(t, ok)
+	require.Len(t, hosts, 2)
+	require.NotContains(t, unboundXML(t, restores[0]), "127.0.0.1")
+	customOptions := strings.TrimPrefix(section[unboundCustomOptionsKey].(string), "string:")
+	require.Contains(t, s.decodeCustomOptions(customOptions), `local-data: 'app.example.com. IN TXT "heritage=external-dns,external-dns/owner=default"'`)
+}
@@ -0,0 +1,107 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// DomainFilters are the domains external-dns is asked to manage. They follow external-dns semantics:
+// `example.com` covers the domain and all its subdomains, `.example.com` covers the subdomains only.
+// Empty filters cover every name.
+type DomainFilters struct {
+	Filters []string
+	// DeriveFromUnbound adds the domains that already exist in the unbound section to the filters
+	DeriveFromUnbound bool
+}
+
+func (f DomainFilters) normalize() DomainFilters {
+	filters := integration.MapSlice(f.Filters, func(filter string) string {
+		return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(filter), "."))
+	})
+	filters = integration.FilterSlice(filters, func(filter string) bool {
+		return filter != "" && filter != "."
+	})
+	return DomainFilters{
+		Filters:           integration.UniqueSlice(filters),
+		DeriveFromUnbound: f.DeriveFromUnbound,
+	}
+}
+
+func (s *pfsenseService) DomainFilters(ctx context.Context) ([]string, error) {
+	if !s.domainFilters.DeriveFromUnbound {
+		return slices.Clone(s.domainFilters.Filters), nil
+	}
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	return s.resolveDomainFilters(section)
+}
+
+// resolveDomainFilters returns the configured filters together with the ones derived from the section: the domains
+// of the host overrides, of the records in the managed block of custom options and of the domain overrides.
+func (s *pfsenseService) resolveDomainFilters(section unbound) ([]string, error) {
+	filters := slices.Clone(s.domainFilters.Filters)
+	if s.domainFilters.DeriveFromUnbound {
+		domains, err := s.unboundDomains(section)
+		if err != nil {
+			return nil, err
+		}
+		for _, domain := range domains {
+			if domain = strings.ToLower(strings.Trim(domain, ".")); domain != "" {
+				filters = append(filters, domain)
+			}
+		}
+	}
+	filters = integration.UniqueSlice(filters)
+	slices.Sort(filters)
+	return filters, nil
+}
+
+// unboundDomains returns the domains that already exist in the section.
+func (s *pfsenseService) unboundDomains(section unbound) ([]string, error) {
+	hosts, err := section.hosts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host overrides; %w", err)
+	}
+	domains := integration.MapSlice(hosts, func(h host) string {
+		return h.Domain
+	})
+	options, err := s.parseCustomOptions(section.customOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse custom options; %w", err)
+	}
+	for _, record := range options.records {
+		// the domain is split off the same way as for a host override of the same name
+		if _, domain, err := s.explodeHostName(record.endpoint.DNSName); err == nil {
+			domains = append(domains, domain)
+		}
+	}
+	overrides, err := section.domainOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read domain overrides; %w", err)
+	}
+	return append(domains, overrides...), nil
+}
+
+// inDomainFilters reports whether the dns name is covered by the resolved filters; empty filters cover every name.
+func (s *pfsenseService) inDomainFilters(dnsName string, filters []string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(filters, func(filter string) bool {
+		return s.matchesDomainFilter(dnsName, filter)
+	})
+}
+
+func (s *pfsenseService) matchesDomainFilter(dnsName string, filter string) bool {
+	name := strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	if strings.HasPrefix(filter, ".") {
+		return strings.HasSuffix(name, filter)
+	}
+	return name == filter || strings.HasSuffix(name, "."+filter)
+}
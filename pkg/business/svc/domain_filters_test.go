@@ -0,0 +1,56 @@
+package svc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_derive_domain_filters_from_unbound_section(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{DomainFilters: DomainFilters{Filters: []string{"example.org"}, DeriveFromUnbound: true}})
+	section := unbound{&integration.XMLRPCStruct{}}
+	section.setHosts([]host{{Host: "nas", Domain: "Home.Arpa.", Ip: "192.168.1.5"}})
+	options, err := s.renderCustomOptions(customOptions{}, []unboundRecord{
+		{endpoint: UnboundEndpoint{DNSName: "txt.example.net", Targets: []string{"\"hello\""}, RecordType: recordTypeTXT}, managed: true},
+	})
+	require.NoError(t, err)
+	section.setCustomOptions(options)
+	section.Set(unboundDomainOverridesKey, []any{
+		&integration.XMLRPCStruct{Members: []integration.XMLRPCMember{{Name: "domain", Value: "corp.example.com"}, {Name: "ip", Value: "10.10.0.53"}}},
+	})
+
+	filters, err := s.resolveDomainFilters(section)
+	require.NoError(t, err)
+	require.Equal(t, []string{"corp.example.com", "example.net", "example.org", "home.arpa"}, filters)
+
+	s.domainFilters.DeriveFromUnbound = false
+	filters, err = s.resolveDomainFilters(section)
+	require.NoError(t, err)
+	require.Equal(t, []string{"example.org"}, filters)
+}
+
+func Test_should_enforce_derived_domain_filters(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{DomainFilters: DomainFilters{DeriveFromUnbound: true}})
+
+	filters, err := s.DomainFilters(t.Context())
+	require.NoError(t, err)
+	require.Equal(t, []string{"corp.example.com", "example.com", "home.arpa"}, filters)
+
+	// a domain that does not exist in pfsense yet cannot be added in derive mode
+	var validationErr *integration.ValidationError
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{{DNSName: "app.example.net", Targets: []string{"10.0.0.20"}, RecordType: recordTypeA}}, nil, nil, nil)
+	require.ErrorAs(t, err, &validationErr)
+	require.Empty(t, pfsense.restores())
+
+	require.NoError(t, s.ApplyChanges(t.Context(), []UnboundEndpoint{{DNSName: "db.corp.example.com", Targets: []string{"10.10.0.20"}, RecordType: recordTypeA}}, nil, nil, nil))
+	require.Len(t, pfsense.restores(), 1)
+}
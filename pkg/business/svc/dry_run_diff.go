@@ -0,0 +1,143 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// maxDryRunDiffs is the number of the latest dry run diffs kept in memory
+const maxDryRunDiffs = 20
+
+// DryRunDiff is a unified diff between the unbound section in pfsense and the section the changes would produce.
+type DryRunDiff struct {
+	Time    time.Time `json:"time"`
+	TraceID string    `json:"traceId,omitempty"`
+	// Hosts is the diff of the host overrides flattened to one line per host
+	Hosts string `json:"hosts"`
+	// XML is the diff of the whole section, with custom options decoded
+	XML string `json:"xml"`
+}
+
+// dryRunDiffs keeps the latest diffs, the oldest ones are dropped.
+type dryRunDiffs struct {
+	mu    sync.Mutex
+	diffs []DryRunDiff
+}
+
+func (d *dryRunDiffs) add(diff DryRunDiff) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.diffs = append(d.diffs, diff)
+	if len(d.diffs) > maxDryRunDiffs {
+		d.diffs = slices.Delete(d.diffs, 0, len(d.diffs)-maxDryRunDiffs)
+	}
+}
+
+// recent returns the diffs, the newest first.
+func (d *dryRunDiffs) recent() []DryRunDiff {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	recent := slices.Clone(d.diffs)
+	slices.Reverse(recent)
+	return recent
+}
+
+func (s *pfsenseService) RecentDryRunDiffs() []DryRunDiff {
+	return s.dryRunDiffs.recent()
+}
+
+// recordDryRunDiff logs the diff between the original and the final section and keeps it for the actuator.
+func (s *pfsenseService) recordDryRunDiff(ctx context.Context, original unbound, section unbound) {
+	diff := DryRunDiff{
+		Time:    time.Now().UTC(),
+		TraceID: integration.TraceID(ctx),
+		Hosts:   s.unifiedDiff(s.renderHostTable(original), s.renderHostTable(section)),
+		XML:     s.unifiedDiff(s.renderSectionXML(original), s.renderSectionXML(section)),
+	}
+	s.dryRunDiffs.add(diff)
+	slog.InfoContext(ctx, "dry run diff of unbound section", slog.String("hosts", diff.Hosts), slog.String("xml", diff.XML))
+}
+
+func (s *pfsenseService) unifiedDiff(current string, planned string) string {
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(current),
+		B:        difflib.SplitLines(planned),
+		FromFile: "pfsense",
+		ToFile:   "planned",
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Sprintf("failed to build diff; %s", err)
+	}
+	return diff
+}
+
+// renderHostTable renders the host overrides one per line, sorted by name, so the diff shows the changed hosts only.
+func (s *pfsenseService) renderHostTable(section unbound) string {
+	hosts, err := section.hosts()
+	if err != nil {
+		return fmt.Sprintf("failed to read host overrides; %s\n", err)
+	}
+	lines := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		name, err := s.buildDNSName(h.Host, h.Domain)
+		if err != nil {
+			name = h.Host + "." + h.Domain
+		}
+		lines = append(lines, fmt.Sprintf("%s ip=%s descr=%s\n", name, h.Ip, h.Descr))
+	}
+	slices.Sort(lines)
+	return strings.Join(lines, "")
+}
+
+// renderSectionXML renders the section the way pfsense keeps it in config.xml.
+func (s *pfsenseService) renderSectionXML(section unbound) string {
+	var builder strings.Builder
+	s.renderXMLElement(&builder, unboundConfigSection, section.XMLRPCStruct, 0)
+	return builder.String()
+}
+
+func (s *pfsenseService) renderXMLElement(builder *strings.Builder, name string, value any, depth int) {
+	indent := strings.Repeat("\t", depth)
+	switch v := value.(type) {
+	case *integration.XMLRPCStruct:
+		fmt.Fprintf(builder, "%s<%s>\n", indent, name)
+		for _, member := range v.Members {
+			s.renderXMLElement(builder, member.Name, member.Value, depth+1)
+		}
+		fmt.Fprintf(builder, "%s</%s>\n", indent, name)
+	case []any:
+		// pfsense keeps lists as repeated elements
+		for _, item := range v {
+			s.renderXMLElement(builder, name, item, depth)
+		}
+	case integration.XMLRPCScalar:
+		s.renderXMLElement(builder, name, v.Text, depth)
+	case nil:
+		// a member without a value is an empty element in config.xml
+		fmt.Fprintf(builder, "%s<%s></%s>\n", indent, name, name)
+	default:
+		text := fmt.Sprintf("%v", v)
+		if name == unboundCustomOptionsKey {
+			text = s.decodeCustomOptions(text)
+		}
+		if !strings.Contains(strings.TrimSuffix(text, "\n"), "\n") {
+			fmt.Fprintf(builder, "%s<%s>%s</%s>\n", indent, name, integration.XMLEscaper.Replace(strings.TrimSuffix(text, "\n")), name)
+			return
+		}
+		// multi-line values are rendered line by line, so the diff points at the changed lines
+		fmt.Fprintf(builder, "%s<%s>\n", indent, name)
+		for line := range strings.SplitSeq(strings.TrimSuffix(text, "\n"), "\n") {
+			fmt.Fprintf(builder, "%s\t%s\n", indent, integration.XMLEscaper.Replace(line))
+		}
+		fmt.Fprintf(builder, "%s</%s>\n", indent, name)
+	}
+}
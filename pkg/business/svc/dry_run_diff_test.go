@@ -0,0 +1,43 @@
+package svc
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_keep_latest_dry_run_diffs(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	original := unbound{&integration.XMLRPCStruct{}}
+	original.setHosts([]host{
+		{Host: "a", Domain: "example.com", Ip: "1.1.1.1"},
+		{Host: "b", Domain: "example.com", Ip: "2.2.2.2"},
+	})
+	original.setCustomOptions(base64.StdEncoding.EncodeToString([]byte("server:\nlocal-data: \"c.example.com A 3.3.3.3\"\n")))
+	section := original.clone()
+	section.setHosts([]host{
+		{Host: "a", Domain: "example.com", Ip: "9.9.9.9"},
+		{Host: "b", Domain: "example.com", Ip: "2.2.2.2"},
+	})
+
+	for range maxDryRunDiffs + 1 {
+		s.recordDryRunDiff(t.Context(), original, section)
+	}
+
+	diffs := s.RecentDryRunDiffs()
+	require.Len(t, diffs, maxDryRunDiffs)
+	require.Contains(t, diffs[0].Hosts, "-a.example.com ip=1.1.1.1")
+	require.Contains(t, diffs[0].Hosts, "+a.example.com ip=9.9.9.9")
+	require.Contains(t, diffs[0].XML, "+\t\t<ip>9.9.9.9</ip>")
+	require.Contains(t, s.renderSectionXML(section), `local-data: "c.example.com A 3.3.3.3"`)
+
+	// members without a value are empty elements, markup is escaped the way the xml-rpc client does
+	section.Set("enable", nil)
+	section.Set("descr", "a & b")
+	require.Contains(t, s.renderSectionXML(section), "\t<enable></enable>\n")
+	require.Contains(t, s.renderSectionXML(section), "\t<descr>a &amp; b</descr>\n")
+}
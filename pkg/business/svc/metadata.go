@@ -0,0 +1,111 @@
+package svc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// metadataVersion is the version of the metadata envelope written by the webhook. Older versions of the webhook
+// stored the bare endpoint, which is read as version 0 and upgraded on the next write.
+const metadataVersion = 1
+
+// metadataEnvelope is what the webhook keeps in the description of a host override and in the managed
+// block of custom options. The checksum covers the endpoint, so hand edits are detected rather than trusted; the
+// name of the endpoint is checked against the host override it is read from, so moved metadata is detected as well.
+type metadataEnvelope struct {
+	Version   int             `json:"version"`
+	OwnerID   string          `json:"ownerId"`
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	Checksum  string          `json:"checksum"`
+	Endpoint  json.RawMessage `json:"endpoint"`
+}
+
+// recordMetadata is the part of the envelope that is carried along with a record between reading and writing it.
+type recordMetadata struct {
+	ownerID string
+	created time.Time
+	updated time.Time
+	// legacy is set when the metadata is in the format written before the envelope was introduced
+	legacy bool
+}
+
+// encodeMetadata wraps the endpoint into the envelope. The timestamps that are not set yet are filled in, so new
+// and changed records get the current time while unchanged ones are encoded exactly as they were read. The owner is
+// written as given, so upgraded legacy metadata stays without an owner until the record is changed.
+func (s *pfsenseService) encodeMetadata(endpoint UnboundEndpoint, meta recordMetadata) string {
+	now := time.Now().UTC().Truncate(time.Second)
+	if meta.created.IsZero() {
+		meta.created = now
+	}
+	if meta.updated.IsZero() {
+		meta.updated = now
+	}
+	endpointJSON, _ := json.Marshal(endpoint)
+	envelope, _ := json.Marshal(metadataEnvelope{
+		Version:   metadataVersion,
+		OwnerID:   meta.ownerID,
+		CreatedAt: meta.created,
+		UpdatedAt: meta.updated,
+		Checksum:  s.metadataChecksum(endpointJSON),
+		Endpoint:  endpointJSON,
+	})
+	return base64.StdEncoding.EncodeToString(envelope)
+}
+
+func (s *pfsenseService) decodeMetadata(metadata string) (UnboundEndpoint, recordMetadata, error) {
+	decoded, err := base64.StdEncoding.DecodeString(metadata)
+	if err != nil {
+		return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("failed to decode base64 metadata; %w", err)
+	}
+	return s.unmarshalMetadata(decoded)
+}
+
+// unmarshalMetadata reads the envelope, or the bare endpoint that was stored before the envelope was introduced.
+func (s *pfsenseService) unmarshalMetadata(data []byte) (UnboundEndpoint, recordMetadata, error) {
+	var envelope metadataEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("failed to unmarshal metadata %s; %w", data, err)
+	}
+
+	if envelope.Version == 0 {
+		var endpoint UnboundEndpoint
+		if err := json.Unmarshal(data, &endpoint); err != nil {
+			return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("failed to unmarshal legacy metadata %s to endpoint; %w", data, err)
+		}
+		// any json object reads as a legacy endpoint, e.g. `{}`, but only one with a name can be a record
+		if endpoint.DNSName == "" {
+			return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("legacy metadata %s has no dns name", data)
+		}
+		return endpoint, recordMetadata{legacy: true}, nil
+	}
+	if envelope.Version > metadataVersion {
+		return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("metadata version %d is newer than the supported version %d", envelope.Version, metadataVersion)
+	}
+	if envelope.Checksum != s.metadataChecksum(envelope.Endpoint) {
+		return UnboundEndpoint{}, recordMetadata{}, errors.New("metadata checksum does not match the endpoint, it was changed outside of the webhook")
+	}
+
+	var endpoint UnboundEndpoint
+	if err := json.Unmarshal(envelope.Endpoint, &endpoint); err != nil {
+		return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("failed to unmarshal endpoint %s of metadata; %w", envelope.Endpoint, err)
+	}
+	if endpoint.DNSName == "" {
+		return UnboundEndpoint{}, recordMetadata{}, fmt.Errorf("endpoint %s of metadata has no dns name", envelope.Endpoint)
+	}
+	return endpoint, recordMetadata{
+		ownerID: envelope.OwnerID,
+		created: envelope.CreatedAt,
+		updated: envelope.UpdatedAt,
+	}, nil
+}
+
+func (s *pfsenseService) metadataChecksum(endpoint []byte) string {
+	sum := sha256.Sum256(endpoint)
+	return hex.EncodeToString(sum[:])
+}
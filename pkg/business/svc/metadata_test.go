@@ -0,0 +1,129 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_read_metadata_envelope_and_legacy_metadata(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{OwnerID: "cluster-a"})
+	endpoint := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10"}, RecordType: recordTypeA}
+	created := time.Date(2025, 1, 15, 9, 30, 0, 0, time.UTC)
+
+	decoded, meta, err := s.decodeMetadata(s.encodeMetadata(endpoint, recordMetadata{ownerID: "cluster-a", created: created}))
+	require.NoError(t, err)
+	require.Equal(t, endpoint, decoded)
+	require.Equal(t, "cluster-a", meta.ownerID)
+	require.Equal(t, created, meta.created)
+	require.False(t, meta.updated.Before(created))
+	require.False(t, meta.legacy)
+
+	legacy, err := json.Marshal(endpoint)
+	require.NoError(t, err)
+	decoded, meta, err = s.decodeMetadata(base64.StdEncoding.EncodeToString(legacy))
+	require.NoError(t, err)
+	require.Equal(t, endpoint, decoded)
+	require.True(t, meta.legacy)
+
+	// an endpoint edited by hand does not match the checksum anymore
+	envelope, err := base64.StdEncoding.DecodeString(s.encodeMetadata(endpoint, recordMetadata{}))
+	require.NoError(t, err)
+	edited := bytes.Replace(envelope, []byte("10.0.0.10"), []byte("10.0.0.99"), 1)
+	_, _, err = s.decodeMetadata(base64.StdEncoding.EncodeToString(edited))
+	require.ErrorContains(t, err, "checksum")
+
+	_, _, err = s.decodeMetadata(base64.StdEncoding.EncodeToString([]byte(`{"version":2}`)))
+	require.ErrorContains(t, err, "newer than the supported version")
+
+	// `{}` reads as a legacy endpoint without a name, which cannot be a record
+	_, _, err = s.decodeMetadata("e30=")
+	require.ErrorContains(t, err, "has no dns name")
+}
+
+func Test_should_migrate_legacy_metadata_in_place(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+	envelope := hostDescr(t, backup, "app")
+
+	// the description of app.example.com as it was written before the envelope was introduced
+	legacy := bytes.Replace(backup, []byte(envelope),
+		[]byte("eyJkbnNOYW1lIjoiYXBwLmV4YW1wbGUuY29tIiwidGFyZ2V0cyI6WyIxMC4wLjAuMTAiLCIxMC4wLjAuMTEiXSwicmVjb3JkVHlwZSI6IkEifQ=="), 1)
+	pfsense.setBackup(legacy)
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA})
+
+	require.NoError(t, s.MigrateRecords(t.Context()))
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	endpoint, meta, err := s.decodeMetadata(hostDescr(t, restores[0], "app"))
+	require.NoError(t, err)
+	require.False(t, meta.legacy)
+	// the migration does not claim the record, it stays without an owner
+	require.Empty(t, meta.ownerID)
+	require.Equal(t, UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}, endpoint)
+
+	// the first real change claims the record for the owner of the instance
+	require.NoError(t, s.ApplyChanges(t.Context(), nil,
+		[]UnboundEndpoint{{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}},
+		[]UnboundEndpoint{{DNSName: "app.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA}}, nil))
+	restores = pfsense.restores()
+	require.Len(t, restores, 2)
+	_, meta, err = s.decodeMetadata(hostDescr(t, restores[1], "app"))
+	require.NoError(t, err)
+	require.Equal(t, "default", meta.ownerID)
+
+	// records already in the envelope are not migrated again
+	pfsense.setBackup(backup)
+	require.NoError(t, s.MigrateRecords(t.Context()))
+	require.Len(t, pfsense.restores(), 2)
+}
+
+func Test_should_respect_owner_of_records_in_managed_mode(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	app := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}
+	moved := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA}
+
+	// app.example.com is owned by `default` in the fixture
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{OwnershipMode: ownershipModeManaged, OwnerID: "cluster-b"})
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.NotContains(t, endpoints, app)
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{moved}, nil, nil, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+	err = s.ApplyChanges(t.Context(), nil, nil, nil, []UnboundEndpoint{app})
+	require.True(t, integration.IsResourceConflictError(err), err)
+	require.Empty(t, pfsense.restores())
+
+	s = newTestService(t, pfsense.client, PfsenseOptions{OwnershipMode: ownershipModeManaged})
+	endpoints, err = s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, app)
+
+	// in all mode any record is changed, but it keeps its owner
+	s = newTestService(t, pfsense.client, PfsenseOptions{OwnerID: "cluster-b"})
+	require.NoError(t, s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{app}, []UnboundEndpoint{moved}, nil))
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	_, meta, err := s.decodeMetadata(hostDescr(t, restores[0], "app"))
+	require.NoError(t, err)
+	require.Equal(t, "default", meta.ownerID)
+}
@@ -0,0 +1,23 @@
+package svc
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var meter = otel.Meter("github.com/slamdev/external-dns-pfsense-webhook/pkg/business/svc")
+
+var safetyLimitViolations, _ = meter.Int64Counter("pfsense.safety_limit.violations",
+	metric.WithDescription("Number of change batches refused because they exceed a safety limit"),
+	metric.WithUnit("{batch}"),
+)
+
+var invalidEndpoints, _ = meter.Int64Counter("pfsense.endpoints.invalid",
+	metric.WithDescription("Number of endpoints refused by validation; in lenient mode they are skipped and the rest of the batch is applied"),
+	metric.WithUnit("{endpoint}"),
+)
+
+var quarantinedRecords, _ = meter.Int64Gauge("pfsense.records.quarantined",
+	metric.WithDescription("Number of host overrides and custom options records not reported to external-dns because they cannot be read as records"),
+	metric.WithUnit("{record}"),
+)
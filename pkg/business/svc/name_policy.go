@@ -0,0 +1,54 @@
+package svc
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// NamePolicy limits the dns names the webhook manages with regular expressions, the same way
+// `--regex-domain-filter` and `--regex-domain-exclusion` do in external-dns.
+type NamePolicy struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func NewNamePolicy(include []string, exclude []string) (NamePolicy, error) {
+	includeRegexps, err := compilePatterns(include)
+	if err != nil {
+		return NamePolicy{}, fmt.Errorf("invalid include pattern; %w", err)
+	}
+	excludeRegexps, err := compilePatterns(exclude)
+	if err != nil {
+		return NamePolicy{}, fmt.Errorf("invalid exclude pattern; %w", err)
+	}
+	return NamePolicy{include: includeRegexps, exclude: excludeRegexps}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	patterns = integration.FilterSlice(patterns, func(pattern string) bool {
+		return strings.TrimSpace(pattern) != ""
+	})
+	return integration.MapSliceErr(patterns, func(pattern string) (*regexp.Regexp, error) {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %+v; %w", pattern, err)
+		}
+		return compiled, nil
+	})
+}
+
+// Allows reports whether the name matches any include pattern (or there are none) and no exclude pattern.
+func (p NamePolicy) Allows(dnsName string) bool {
+	name := strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	matches := func(pattern *regexp.Regexp) bool {
+		return pattern.MatchString(name)
+	}
+	if len(p.include) > 0 && !slices.ContainsFunc(p.include, matches) {
+		return false
+	}
+	return !slices.ContainsFunc(p.exclude, matches)
+}
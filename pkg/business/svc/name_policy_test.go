@@ -0,0 +1,59 @@
+package svc
+
+import (
+	"os"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_allow_names_by_include_and_exclude_patterns(t *testing.T) {
+	t.Parallel()
+
+	policy, err := NewNamePolicy([]string{`^.*\.example\.com$`, " "}, []string{`^mail\.example\.com$`})
+	require.NoError(t, err)
+	require.True(t, policy.Allows("app.example.com"))
+	require.True(t, policy.Allows("App.Example.com."))
+	require.False(t, policy.Allows("mail.example.com"))
+	require.False(t, policy.Allows("nas.home.arpa"))
+
+	// without patterns every name is allowed
+	require.True(t, NamePolicy{}.Allows("nas.home.arpa"))
+
+	_, err = NewNamePolicy(nil, []string{"("})
+	require.ErrorContains(t, err, "invalid exclude pattern")
+}
+
+func Test_should_enforce_name_policy(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	policy, err := NewNamePolicy([]string{`\.example\.com$`}, []string{`^www\.`})
+	require.NoError(t, err)
+	s := newTestService(t, pfsense.client, PfsenseOptions{NamePolicy: policy})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	names := integration.MapSlice(endpoints, func(endpoint UnboundEndpoint) string {
+		return endpoint.DNSName
+	})
+	require.Equal(t, []string{"app.example.com"}, names)
+
+	adjusted, err := s.AdjustEndpoints(t.Context(), []UnboundEndpoint{
+		{DNSName: "api.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+		{DNSName: "www.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME},
+		{DNSName: "printer.home.arpa", Targets: []string{"192.168.1.7"}, RecordType: recordTypeA},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []UnboundEndpoint{{DNSName: "api.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA}}, adjusted)
+
+	var validationErr *integration.ValidationError
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{{DNSName: "printer.home.arpa", Targets: []string{"192.168.1.7"}, RecordType: recordTypeA}}, nil, nil, nil)
+	require.ErrorAs(t, err, &validationErr)
+	err = s.ApplyChanges(t.Context(), nil, nil, nil, []UnboundEndpoint{{DNSName: "www.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME}})
+	require.ErrorAs(t, err, &validationErr)
+	require.Empty(t, pfsense.restores())
+}
@@ -1,176 +1,723 @@
 package svc
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"slices"
 	"strings"
 
-	"alexejk.io/go-xmlrpc"
 	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
 )
 
 const unboundConfigSection string = "unbound"
 
+// maxMergeAttempts limits how many times changes are merged again when the section is changed concurrently
+const maxMergeAttempts = 3
+
+var errSectionChanged = errors.New("unbound section was changed in pfsense since it was fetched")
+
+// reloadSteps configure the services that depend on the unbound section, in order
+var reloadSteps = []struct {
+	name string
+	code string
+}{
+	{name: "unbound", code: "$toreturn = services_unbound_configure(false);"},
+	{name: "dhcpd", code: "$toreturn = services_dhcpd_configure();"},
+}
+
+const (
+	// ownershipModeAll exposes every host override to external-dns
+	ownershipModeAll = "all"
+	// ownershipModeManaged exposes and changes only the records that carry webhook metadata of the same owner
+	ownershipModeManaged = "managed"
+)
+
+const (
+	recordTypeA     = "A"
+	recordTypeAAAA  = "AAAA"
+	recordTypeCNAME = "CNAME"
+	recordTypeMX    = "MX"
+	recordTypePTR   = "PTR"
+	recordTypeSRV   = "SRV"
+	recordTypeTXT   = "TXT"
+)
+
 type pfsenseService struct {
-	client *xmlrpc.Client
-	dryRun bool
+	client        *integration.XMLRPCClient
+	dryRun        bool
+	zones         []string
+	ownershipMode string
+	safetyLimits  SafetyLimits
+	domainFilters DomainFilters
+	namePolicy    NamePolicy
+	audit         AuditLog
+	dryRunDiffs   *dryRunDiffs
+	// validationMode is either validationModeStrict or validationModeLenient
+	validationMode string
+	// ownerID is written to the metadata of the records this instance creates or changes
+	ownerID string
 }
 
 type PfsenseService interface {
 	ListEndpoints(ctx context.Context) ([]UnboundEndpoint, error)
-	ApplyChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error
+	// ApplyChanges merges the changes into pfsense. toUpdateOld holds the records as external-dns saw them, paired
+	// by index with toUpdate; it may be empty, then every update replaces the record of the same name.
+	ApplyChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error
+	PlanChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (Plan, error)
+	AdjustEndpoints(ctx context.Context, endpoints []UnboundEndpoint) ([]UnboundEndpoint, error)
+	MigrateRecords(ctx context.Context) error
+	DomainFilters(ctx context.Context) ([]string, error)
+	QuarantinedRecords(ctx context.Context) ([]QuarantinedRecord, error)
+	RepairQuarantinedRecords(ctx context.Context) ([]QuarantinedRecord, error)
+	// RecentDryRunDiffs returns the diffs of the latest changes that were not applied in dry run, the newest first
+	RecentDryRunDiffs() []DryRunDiff
 }
 
-func NewPfsenseService(client *xmlrpc.Client, dryRun bool) PfsenseService {
-	return &pfsenseService{
-		client: client,
-		dryRun: dryRun,
+// PfsenseOptions configure how the pfsense service manages the unbound section.
+type PfsenseOptions struct {
+	// DryRun logs the changes instead of applying them
+	DryRun bool
+	// Zones split dns names into host and domain on the longest matching zone; all names are managed when empty
+	Zones []string
+	// OwnershipMode is either `all` or `managed`
+	OwnershipMode string
+	// ValidationMode is either `strict` or `lenient`
+	ValidationMode string
+	// OwnerID is written to the metadata of the records this instance creates or changes
+	OwnerID       string
+	SafetyLimits  SafetyLimits
+	DomainFilters DomainFilters
+	NamePolicy    NamePolicy
+	Audit         AuditLog
+}
+
+func NewPfsenseService(client *integration.XMLRPCClient, options PfsenseOptions) (PfsenseService, error) {
+	if !slices.Contains([]string{ownershipModeAll, ownershipModeManaged}, options.OwnershipMode) {
+		return nil, fmt.Errorf("ownership mode should be one of [%s %s], got %+v", ownershipModeAll, ownershipModeManaged, options.OwnershipMode)
+	}
+	if !slices.Contains([]string{validationModeStrict, validationModeLenient}, options.ValidationMode) {
+		return nil, fmt.Errorf("validation mode should be one of [%s %s], got %+v", validationModeStrict, validationModeLenient, options.ValidationMode)
 	}
+	if strings.TrimSpace(options.OwnerID) == "" {
+		return nil, errors.New("owner id should not be empty")
+	}
+	if err := options.SafetyLimits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid safety limits; %w", err)
+	}
+	normalizedZones := integration.UniqueSlice(integration.MapSlice(options.Zones, func(zone string) string {
+		return strings.ToLower(strings.Trim(strings.TrimSpace(zone), "."))
+	}))
+	normalizedZones = integration.FilterSlice(normalizedZones, func(zone string) bool {
+		return zone != ""
+	})
+	slices.SortFunc(normalizedZones, func(a, b string) int {
+		return len(b) - len(a)
+	})
+	return &pfsenseService{
+		client:         client,
+		dryRun:         options.DryRun,
+		zones:          normalizedZones,
+		ownershipMode:  options.OwnershipMode,
+		safetyLimits:   options.SafetyLimits,
+		domainFilters:  options.DomainFilters.normalize(),
+		namePolicy:     options.NamePolicy,
+		audit:          options.Audit,
+		dryRunDiffs:    &dryRunDiffs{},
+		validationMode: options.ValidationMode,
+		ownerID:        options.OwnerID,
+	}, nil
 }
 
-func (s *pfsenseService) ListEndpoints(_ context.Context) ([]UnboundEndpoint, error) {
-	section, err := s.fetchUnboundSection()
+func (s *pfsenseService) ListEndpoints(ctx context.Context) ([]UnboundEndpoint, error) {
+	section, err := s.fetchUnboundSection(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch unbound section; %w", err)
 	}
-	endpoints, err := integration.MapSliceErr(section.Hosts, s.hostToEndpoint)
+	records, err := s.readRecords(section)
 	if err != nil {
-		return nil, fmt.Errorf("failed to map hosts to endpoints; %w", err)
+		return nil, fmt.Errorf("failed to read unbound records; %w", err)
+	}
+	endpoints := make([]UnboundEndpoint, 0, len(records))
+	var quarantined int64
+	for _, record := range records {
+		// an unreadable host override must not stop external-dns from reconciling the rest
+		if s.quarantined(record) {
+			quarantined++
+			quarantinedRecord := s.toQuarantinedRecord(record)
+			slog.WarnContext(ctx, "record is quarantined, it cannot be read", slog.String("host", quarantinedRecord.Host),
+				slog.String("domain", quarantinedRecord.Domain), slog.String("record", quarantinedRecord.Record), slog.Any("err", record.readErr))
+			continue
+		}
+		if s.exposed(record) {
+			endpoints = append(endpoints, record.endpoint)
+		}
 	}
+	quarantinedRecords.Record(ctx, quarantined)
 	return endpoints, nil
 }
 
-func (s *pfsenseService) fetchUnboundSection() (unbound, error) {
-	req := &struct{ Data []string }{Data: []string{unboundConfigSection}}
-	res := &integration.NestedXMLRPC[unboundStruct]{}
-	if err := s.client.Call("pfsense.backup_config_section", req, res); err != nil {
+// exposed reports whether the record is reported to external-dns.
+func (s *pfsenseService) exposed(record unboundRecord) bool {
+	if record.readErr != nil {
+		return false
+	}
+	// records outside of managed zones or the name policy are not reported, so external-dns never tries to own them
+	if !s.inManagedZones(record.endpoint.DNSName) || !s.namePolicy.Allows(record.endpoint.DNSName) {
+		return false
+	}
+	return s.ownershipMode != ownershipModeManaged || (record.managed && !s.ownedByOther(record))
+}
+
+// ownedByOther reports whether the record was created by another webhook instance, which is respected in managed
+// ownership mode only. Metadata written before owners were recorded has no owner and is adopted by any instance.
+func (s *pfsenseService) ownedByOther(record unboundRecord) bool {
+	if s.ownershipMode != ownershipModeManaged || !record.managed {
+		return false
+	}
+	return record.meta.ownerID != "" && record.meta.ownerID != s.ownerID
+}
+
+func (s *pfsenseService) fetchUnboundSection(ctx context.Context) (unbound, error) {
+	res, err := s.client.Call(ctx, "pfsense.backup_config_section", []string{unboundConfigSection})
+	if err != nil {
 		return unbound{}, fmt.Errorf("failed to call %s; %w", "backup_config_section", err)
 	}
-	return res.Nested.Unbound, nil
+	if len(res) == 0 {
+		return unbound{}, errors.New("backup_config_section returned no value")
+	}
+	sections, ok := res[0].(*integration.XMLRPCStruct)
+	if !ok {
+		return unbound{}, fmt.Errorf("backup_config_section should return a struct, got %T", res[0])
+	}
+	value, _ := sections.Get(unboundConfigSection)
+	section, ok := value.(*integration.XMLRPCStruct)
+	if !ok {
+		return unbound{}, fmt.Errorf("%s section should be a struct, got %T", unboundConfigSection, value)
+	}
+	return unbound{section}, nil
 }
 
-func (s *pfsenseService) ApplyChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error {
+func (s *pfsenseService) ApplyChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error {
 	if len(toCreate) == 0 && len(toUpdate) == 0 && len(toDelete) == 0 {
 		return nil
 	}
 
-	section, err := s.fetchUnboundSection()
+	filters, err := s.DomainFilters(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to fetch unbound section; %w", err)
+		return fmt.Errorf("failed to resolve domain filters; %w", err)
+	}
+	valid, skipped, err := s.verifyEndpoints(ctx, filters, toCreate, toUpdateOld, toUpdate, toDelete)
+	if err != nil {
+		return err
+	}
+	if err := s.applyValidChanges(ctx, valid); err != nil {
+		return err
+	}
+	if skipped != nil {
+		// the valid changes are in place, the skipped endpoints are still reported so external-dns sees them
+		return skipped
+	}
+	return nil
+}
+
+func (s *pfsenseService) applyValidChanges(ctx context.Context, valid changeSet) error {
+	if valid.empty() {
+		return nil
+	}
+
+	// the section may be changed in pfsense gui while the changes are merged, in that case
+	// the changes are merged again into the fresh section
+	for attempt := 1; ; attempt++ {
+		err := s.mergeAndSave(ctx, valid.toCreate, valid.toUpdateOld, valid.toUpdate, valid.toDelete)
+		if !errors.Is(err, errSectionChanged) {
+			return err
+		}
+		if attempt == maxMergeAttempts {
+			return integration.NewResourceConflictError(fmt.Sprintf("%s, gave up after %d attempts", errSectionChanged, attempt))
+		}
+		slog.InfoContext(ctx, "unbound section was changed concurrently, merging changes again", slog.Int("attempt", attempt))
 	}
-	var finalHosts []host
-	for _, existingHost := range section.Hosts {
-		// do not add an existing host for final host if it is marked for deletion
-		if slices.ContainsFunc(toDelete, func(endpoint UnboundEndpoint) bool {
-			existingDNS, err := s.buildDNSName(existingHost.Host, existingHost.Domain)
-			return err != nil && existingDNS == endpoint.DNSName
-		}) {
+}
+
+func (s *pfsenseService) mergeAndSave(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error {
+	merged, err := s.merge(ctx, toCreate, toUpdateOld, toUpdate, toDelete)
+	if err != nil {
+		s.recordSafetyViolation(ctx, err)
+		return err
+	}
+	section, changes := merged.section, merged.changes
+
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, not applying changes to pfsense",
+			slog.String("changes", integration.ToUnsafeJSONString(changes)),
+		)
+		s.recordDryRunDiff(ctx, merged.original, section)
+		s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeSkipped, nil))
+		return nil
+	}
+
+	err = s.saveUnboundSection(ctx, section, merged.fingerprint)
+	if errors.Is(err, errSectionChanged) {
+		return err
+	}
+	if err != nil {
+		s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeFailed, err))
+		return fmt.Errorf("failed to save unbound section; %w", err)
+	}
+	s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeApplied, nil))
+	return nil
+}
+
+// mergedSection is the unbound section with the changes merged in, together with the section as it was fetched.
+type mergedSection struct {
+	original    unbound
+	section     unbound
+	fingerprint string
+	changes     []recordChange
+}
+
+// merge fetches the unbound section and merges the changes into it without writing anything to pfsense.
+func (s *pfsenseService) merge(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (mergedSection, error) {
+	// merging consumes the slices, so the caller's ones are kept intact for the next attempt
+	toCreate, toDelete = slices.Clone(toCreate), slices.Clone(toDelete)
+
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return mergedSection{}, fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	original := section.clone()
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	if err != nil {
+		return mergedSection{}, fmt.Errorf("failed to read unbound records; %w", err)
+	}
+	if err := s.verifyQuarantine(records, slices.Concat(toCreate, toUpdateOld, toUpdate, toDelete)); err != nil {
+		return mergedSection{}, err
+	}
+	if s.ownershipMode == ownershipModeManaged {
+		if err := s.verifyOwnership(records, slices.Concat(toCreate, toUpdateOld, toUpdate)); err != nil {
+			return mergedSection{}, err
+		}
+	}
+	if err := s.verifySafetyLimits(records, toCreate, toUpdateOld, toUpdate, toDelete); err != nil {
+		return mergedSection{}, err
+	}
+	deleted, err := s.verifyDeletions(records, toDelete)
+	if err != nil {
+		return mergedSection{}, err
+	}
+	updated, missing, err := s.verifyUpdates(records, deleted, toUpdateOld, toUpdate)
+	if err != nil {
+		return mergedSection{}, err
+	}
+	// sometimes external-dns reports a new host as an update
+	finalRecords, changes, err := s.mergeRecords(records, deleted, updated, slices.Concat(missing, toCreate))
+	if err != nil {
+		return mergedSection{}, fmt.Errorf("failed to merge unbound records; %w", err)
+	}
+	if err := s.verifyWildcards(finalRecords, changes); err != nil {
+		return mergedSection{}, err
+	}
+
+	if err := s.writeRecords(section, finalRecords); err != nil {
+		return mergedSection{}, fmt.Errorf("failed to write unbound records; %w", err)
+	}
+	return mergedSection{
+		original:    original,
+		section:     section,
+		fingerprint: fingerprint,
+		changes:     changes,
+	}, nil
+}
+
+// mergeRecords applies the changes to the existing records and returns the final records
+// together with the changes that actually happen to them.
+func (s *pfsenseService) mergeRecords(records []unboundRecord, deleted []bool, updated []*UnboundEndpoint, toCreate []UnboundEndpoint) ([]unboundRecord, []recordChange, error) {
+	var finalRecords []unboundRecord
+	var changes []recordChange
+	for i, existing := range records {
+		// do not add an existing record for final records if it is marked for deletion
+		before := existing.endpoint
+		if deleted[i] {
+			changes = append(changes, recordChange{Action: changeActionDelete, Before: &before})
 			continue
 		}
 
-		// replace existing host with updated host if it is marked for toUpdate
-		updateIndex := slices.IndexFunc(toUpdate, func(endpoint UnboundEndpoint) bool {
-			existingDNS, err := s.buildDNSName(existingHost.Host, existingHost.Domain)
-			return err == nil && existingDNS == endpoint.DNSName
-		})
-		if updateIndex != -1 {
-			var err error
-			existingHost, err = s.endpointToHost(toUpdate[updateIndex])
-			if err != nil {
-				return fmt.Errorf("failed to convert endpoint %+v to host; %w", toUpdate[updateIndex], err)
+		// replace existing record with updated record if it is marked for update, the name may change as well
+		if updated[i] != nil {
+			after := *updated[i]
+			changes = append(changes, recordChange{Action: changeActionUpdate, Before: &before, After: &after})
+			// the record keeps its owner and creation time, the update time is of this change; a record without
+			// an owner, e.g. upgraded from legacy metadata, is claimed by this one
+			meta := recordMetadata{ownerID: existing.meta.ownerID, created: existing.meta.created}
+			if meta.ownerID == "" {
+				meta.ownerID = s.ownerID
 			}
-			toUpdate = append(toUpdate[:updateIndex], toUpdate[updateIndex+1:]...)
+			var rewritten *host
+			if existing.host != nil && s.storedAsHost(after) {
+				// the host override is rewritten in place, so the elements the webhook does not model, e.g. aliases, are kept
+				h, err := s.endpointToHost(after, meta)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to convert endpoint %+v to host; %w", after, err)
+				}
+				h.raw = existing.host.raw
+				rewritten = &h
+			}
+			existing = unboundRecord{endpoint: after, host: rewritten, managed: true, meta: meta}
 		}
 
-		finalHosts = append(finalHosts, existingHost)
+		finalRecords = append(finalRecords, existing)
 
-		// remove entry from created hosts if it already exists
-		createIndex := slices.IndexFunc(toCreate, func(endpoint UnboundEndpoint) bool {
-			existingDNS, err := s.buildDNSName(existingHost.Host, existingHost.Domain)
-			return err == nil && existingDNS == endpoint.DNSName
-		})
+		// remove entry from created records if it already exists
+		createIndex := slices.IndexFunc(toCreate, existing.matches)
 		if createIndex != -1 {
 			toCreate = append(toCreate[:createIndex], toCreate[createIndex+1:]...)
 		}
 	}
 
-	// create remaining updates (sometimes external-dns reports a new host as an update)
-	hostsToUpdate, err := integration.MapSliceErr(toUpdate, s.endpointToHost)
-	if err != nil {
-		return fmt.Errorf("failed to map endpoints to hosts for update; %w", err)
+	// add remaining created records
+	for _, endpoint := range toCreate {
+		finalRecords = append(finalRecords, unboundRecord{endpoint: endpoint, managed: true, meta: recordMetadata{ownerID: s.ownerID}})
+		changes = append(changes, recordChange{Action: changeActionCreate, After: &endpoint})
 	}
-	finalHosts = append(finalHosts, hostsToUpdate...)
+	return finalRecords, changes, nil
+}
 
-	// add remaining created hosts
-	hostsToCreate, err := integration.MapSliceErr(toCreate, s.endpointToHost)
-	if err != nil {
-		return fmt.Errorf("failed to map endpoints to hosts for creation; %w", err)
+// verifyOwnership refuses changes of names that are held by records without webhook metadata or with
+// the metadata of another owner, so hand-made host overrides and records of other instances are never
+// adopted nor overwritten.
+func (s *pfsenseService) verifyOwnership(records []unboundRecord, endpoints []UnboundEndpoint) error {
+	for _, endpoint := range endpoints {
+		for _, record := range records {
+			if record.readErr != nil || record.endpoint.key().DNSName != endpoint.key().DNSName {
+				continue
+			}
+			if !record.managed {
+				return integration.NewResourceConflictError(fmt.Sprintf("dns name %s is held by a host override that was not created by the webhook", endpoint.DNSName))
+			}
+			if s.ownedByOther(record) {
+				return integration.NewResourceConflictError(fmt.Sprintf("dns name %s is held by a record of owner %s", endpoint.DNSName, record.meta.ownerID))
+			}
+		}
+	}
+	return nil
+}
+
+// verifyDeletions returns which records are removed by the delete endpoints. A record is removed only
+// when it was created by the webhook, by this owner in managed ownership mode, and its stored type and
+// targets match the endpoint. Deleting a name held by a hand-made host override or by a record of
+// another owner is reported as a conflict.
+func (s *pfsenseService) verifyDeletions(records []unboundRecord, toDelete []UnboundEndpoint) ([]bool, error) {
+	deleted := make([]bool, len(records))
+	for _, endpoint := range toDelete {
+		index := slices.IndexFunc(records, func(record unboundRecord) bool {
+			return record.managed && !s.ownedByOther(record) && record.matches(endpoint)
+		})
+		if index == -1 {
+			if slices.ContainsFunc(records, func(record unboundRecord) bool {
+				return (!record.managed || s.ownedByOther(record)) && record.readErr == nil && record.endpoint.key().DNSName == endpoint.key().DNSName
+			}) {
+				return nil, integration.NewResourceConflictError(fmt.Sprintf("dns name %s is held by a host override that was not created by the webhook or by another owner, refusing to delete it", endpoint.DNSName))
+			}
+			// the record is already gone
+			continue
+		}
+		existing := records[index].endpoint
+		if !slices.Equal(s.sortTargets(existing.Targets), s.sortTargets(endpoint.Targets)) {
+			return nil, integration.NewResourceConflictError(fmt.Sprintf("%s record %s has targets %+v while %+v are requested for deletion", existing.RecordType, existing.DNSName, existing.Targets, endpoint.Targets))
+		}
+		deleted[index] = true
+	}
+	return deleted, nil
+}
+
+// verifyUpdates returns which records are replaced by the updates. A record is found by the old endpoint
+// external-dns saw, so a record can be renamed, and must still have the old targets; otherwise it was
+// changed in pfsense since external-dns read it and overwriting it is reported as a conflict.
+// Without old endpoints a record is found by the name of the update, and updates of missing records are
+// returned to be created.
+func (s *pfsenseService) verifyUpdates(records []unboundRecord, deleted []bool, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint) ([]*UnboundEndpoint, []UnboundEndpoint, error) {
+	updated := make([]*UnboundEndpoint, len(records))
+	var missing []UnboundEndpoint
+	for i, endpoint := range toUpdate {
+		old := endpoint
+		if len(toUpdateOld) > 0 {
+			old = toUpdateOld[i]
+		}
+		index := slices.IndexFunc(records, func(record unboundRecord) bool {
+			return record.matches(old)
+		})
+		if index == -1 {
+			if len(toUpdateOld) > 0 {
+				return nil, nil, integration.NewResourceConflictError(fmt.Sprintf("%s record %s requested for update no longer exists in pfsense", old.RecordType, old.DNSName))
+			}
+			missing = append(missing, endpoint)
+			continue
+		}
+		if deleted[index] || updated[index] != nil {
+			return nil, nil, integration.NewResourceConflictError(fmt.Sprintf("%s record %s is changed more than once in the same batch", old.RecordType, old.DNSName))
+		}
+		existing := records[index].endpoint
+		if len(toUpdateOld) > 0 && !slices.Equal(s.sortTargets(existing.Targets), s.sortTargets(old.Targets)) {
+			return nil, nil, integration.NewResourceConflictError(fmt.Sprintf("%s record %s has targets %+v while external-dns expects %+v, it was changed since it was read", existing.RecordType, existing.DNSName, existing.Targets, old.Targets))
+		}
+		if old.key() != endpoint.key() {
+			for j, record := range records {
+				if !deleted[j] && record.matches(endpoint) {
+					return nil, nil, integration.NewResourceConflictError(fmt.Sprintf("%s record %s cannot be renamed to %s, the name is already taken", old.RecordType, old.DNSName, endpoint.DNSName))
+				}
+			}
+		}
+		after := endpoint
+		updated[index] = &after
 	}
+	return updated, missing, nil
+}
 
-	finalHosts = append(finalHosts, hostsToCreate...)
+// MigrateRecords rewrites records that are stored in a legacy form, e.g. TXT records that used to be
+// fake host overrides pointing to 127.0.0.1 or metadata written before the versioned envelope.
+// The same migration also happens on every change.
+func (s *pfsenseService) MigrateRecords(ctx context.Context) error {
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	original := section.clone()
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	if err != nil {
+		return fmt.Errorf("failed to read unbound records; %w", err)
+	}
+	legacy := integration.FilterSlice(records, func(record unboundRecord) bool {
+		return record.legacy
+	})
+	if len(legacy) == 0 {
+		return nil
+	}
 
-	section.Hosts = finalHosts
+	if err := s.writeRecords(section, records); err != nil {
+		return fmt.Errorf("failed to write unbound records; %w", err)
+	}
 
 	if s.dryRun {
-		slog.InfoContext(ctx, "dry run enabled, not applying changes to pfsense",
-			slog.String("create", integration.ToUnsafeJSONString(toCreate)),
-			slog.String("update", integration.ToUnsafeJSONString(toUpdate)),
-			slog.String("delete", integration.ToUnsafeJSONString(toDelete)),
-			slog.String("final", integration.ToUnsafeJSONString(section.Hosts)),
+		slog.InfoContext(ctx, "dry run enabled, not migrating legacy records in pfsense",
+			slog.String("legacy", integration.ToUnsafeJSONString(integration.MapSlice(legacy, func(record unboundRecord) UnboundEndpoint {
+				return record.endpoint
+			}))),
 		)
+		s.recordDryRunDiff(ctx, original, section)
 		return nil
 	}
 
-	if err := s.saveUnboundSection(section); err != nil {
+	if err := s.saveUnboundSection(ctx, section, fingerprint); err != nil {
 		return fmt.Errorf("failed to save unbound section; %w", err)
 	}
+	slog.InfoContext(ctx, "migrated legacy records", slog.Int("count", len(legacy)))
 	return nil
 }
 
-func (s *pfsenseService) saveUnboundSection(section unbound) error {
-	req := &struct {
-		Sections any
-		Timeout  int
-	}{
-		Sections: map[string]any{unboundConfigSection: section},
-		Timeout:  30,
+const (
+	changeActionCreate = "create"
+	changeActionUpdate = "update"
+	changeActionDelete = "delete"
+)
+
+// recordChange is a single change of a record; Before is empty for created records and After for deleted ones.
+type recordChange struct {
+	Action string           `json:"action"`
+	Before *UnboundEndpoint `json:"before,omitempty"`
+	After  *UnboundEndpoint `json:"after,omitempty"`
+}
+
+// unboundRecord is a single record stored either as a host override or in the managed block of custom options.
+type unboundRecord struct {
+	endpoint UnboundEndpoint
+	// host is the original host override; it is written back untouched while the record is not changed
+	host *host
+	// managed is set when the record carries webhook metadata, which proves it was created by the webhook
+	managed bool
+	// readErr is set when the host override or the managed record cannot be read as a record; such records are
+	// preserved but never matched
+	readErr error
+	// lines are the custom options of a managed record that cannot be read, they are written back as they are
+	lines []string
+	// legacy is set when the record is stored in a form the webhook no longer writes
+	legacy bool
+	// meta is the metadata of a managed record, it is written back as is while the record is not changed
+	meta recordMetadata
+}
+
+// matches reports whether the record holds the same record as the endpoint.
+func (r unboundRecord) matches(endpoint UnboundEndpoint) bool {
+	return r.readErr == nil && r.endpoint.key() == endpoint.key()
+}
+
+func (s *pfsenseService) readRecords(section unbound) ([]unboundRecord, error) {
+	hosts, err := section.hosts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host overrides; %w", err)
+	}
+	records := make([]unboundRecord, 0, len(hosts))
+	for _, h := range hosts {
+		endpoint, meta, err := s.hostToEndpoint(h)
+		record := unboundRecord{endpoint: endpoint, host: &h, managed: meta != nil, readErr: err}
+		if meta != nil {
+			record.meta = *meta
+			// metadata written before the envelope was introduced is upgraded on the next write
+			record.legacy = meta.legacy
+		}
+		if err == nil && !s.storedAsHost(endpoint) {
+			// records kept in a legacy form, e.g. TXT records stored as fake host overrides,
+			// are moved to custom options on the next write
+			record.host = nil
+			record.legacy = true
+		}
+		records = append(records, record)
 	}
-	res := &integration.OperationResult{}
-	if err := s.client.Call("pfsense.restore_config_section", req, res); err != nil {
+	options, err := s.parseCustomOptions(section.customOptions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse custom options; %w", err)
+	}
+	return append(records, options.records...), nil
+}
+
+func (s *pfsenseService) writeRecords(section unbound, records []unboundRecord) error {
+	options, err := s.parseCustomOptions(section.customOptions())
+	if err != nil {
+		return fmt.Errorf("failed to parse custom options; %w", err)
+	}
+	var hosts []host
+	var managed []unboundRecord
+	for _, record := range records {
+		switch {
+		case record.host != nil && record.meta.legacy:
+			// only the metadata is upgraded, the host override is otherwise kept as it is
+			h := *record.host
+			h.Descr = s.encodeMetadata(record.endpoint, record.meta)
+			hosts = append(hosts, h)
+		case record.host != nil:
+			hosts = append(hosts, *record.host)
+		case record.readErr != nil:
+			managed = append(managed, record)
+		case s.storedAsHost(record.endpoint):
+			h, err := s.endpointToHost(record.endpoint, record.meta)
+			if err != nil {
+				return fmt.Errorf("failed to convert endpoint %+v to host; %w", record.endpoint, err)
+			}
+			hosts = append(hosts, h)
+		default:
+			managed = append(managed, record)
+		}
+	}
+	customOptions, err := s.renderCustomOptions(options, managed)
+	if err != nil {
+		return fmt.Errorf("failed to render custom options; %w", err)
+	}
+	section.setHosts(hosts)
+	section.setCustomOptions(customOptions)
+	return nil
+}
+
+// validateEndpoints checks that every endpoint can be stored, so malformed records are reported
+// as validation errors before anything is changed on pfsense.
+func (s *pfsenseService) validateEndpoints(endpoints []UnboundEndpoint) error {
+	for _, endpoint := range endpoints {
+		if !s.inManagedZones(endpoint.DNSName) {
+			return integration.NewValidationError(fmt.Sprintf("dns name %s is outside of managed zones %+v", endpoint.DNSName, s.zones))
+		}
+		var err error
+		if s.storedAsHost(endpoint) {
+			_, err = s.endpointToHost(endpoint, recordMetadata{})
+		} else {
+			_, err = s.endpointToLocalData(endpoint)
+		}
+		if err != nil {
+			return integration.NewValidationError(fmt.Sprintf("endpoint %s %s cannot be stored; %s", endpoint.DNSName, endpoint.RecordType, err))
+		}
+	}
+	return nil
+}
+
+// storedAsHost reports whether the endpoint is kept as a host override rather than in custom options.
+// Host overrides cannot express wildcards nor ttl, so such records always go to custom options.
+func (s *pfsenseService) storedAsHost(endpoint UnboundEndpoint) bool {
+	if _, ok := s.wildcardZone(endpoint.DNSName); ok {
+		return false
+	}
+	if endpoint.RecordTTL != 0 {
+		return false
+	}
+	return slices.Contains([]string{recordTypeA, recordTypeAAAA}, endpoint.RecordType)
+}
+
+// saveUnboundSection restores the section and reloads the services that depend on it. The section that was
+// in place before is snapshotted first and put back when any step fails, so pfsense is never left half-applied.
+// The snapshot must match the fingerprint of the section the changes were merged into, otherwise somebody
+// changed the section in between and restoring it would silently overwrite their changes.
+func (s *pfsenseService) saveUnboundSection(ctx context.Context, section unbound, fingerprint string) error {
+	snapshot, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot unbound section; %w", err)
+	}
+	if snapshot.fingerprint() != fingerprint {
+		return errSectionChanged
+	}
+	if err := s.applyUnboundSection(ctx, section); err != nil {
+		slog.WarnContext(ctx, "failed to apply unbound section, rolling back to snapshot", slog.Any("error", err))
+		if rollbackErr := s.applyUnboundSection(ctx, snapshot); rollbackErr != nil {
+			return fmt.Errorf("%w; rollback to snapshot failed as well, pfsense config may be half-applied; %w", err, rollbackErr)
+		}
+		return fmt.Errorf("%w; rolled back to snapshot", err)
+	}
+	return nil
+}
+
+func (s *pfsenseService) applyUnboundSection(ctx context.Context, section unbound) error {
+	sections := &integration.XMLRPCStruct{Members: []integration.XMLRPCMember{{Name: unboundConfigSection, Value: section.XMLRPCStruct}}}
+	res, err := s.client.Call(ctx, "pfsense.restore_config_section", sections, 30)
+	if err != nil {
 		return fmt.Errorf("failed to call %s; %w", "restore_config_section", err)
 	}
-	if !res.Success {
+	if !integration.IsXMLRPCSuccess(res) {
 		return errors.New("pfsense return 'false' as a result of config restoring")
 	}
-	if err := s.execPhp("$toreturn = services_unbound_configure(false);"); err != nil {
-		return errors.New("failed to exec php to configure unbound")
-	}
-	if err := s.execPhp("$toreturn = services_dhcpd_configure();"); err != nil {
-		return errors.New("failed to exec php to configure dhcpd")
+	return s.reloadServices(ctx)
+}
+
+// reloadServices configures unbound and dhcpd from the restored config. A failed reload is retried once,
+// since pfsense fails it occasionally while the previous reload is still running.
+func (s *pfsenseService) reloadServices(ctx context.Context) error {
+	for _, step := range reloadSteps {
+		err := s.execPhp(ctx, step.code)
+		if err != nil {
+			err = s.execPhp(ctx, step.code)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to exec php to configure %s; %w", step.name, err)
+		}
 	}
 	return nil
 }
 
-func (s *pfsenseService) execPhp(code string) error {
-	req := &struct{ Data string }{Data: code}
-	res := &integration.OperationResult{}
-	if err := s.client.Call("pfsense.exec_php", req, res); err != nil {
+func (s *pfsenseService) execPhp(ctx context.Context, code string) error {
+	res, err := s.client.Call(ctx, "pfsense.exec_php", code)
+	if err != nil {
 		return fmt.Errorf("failed to exec php; %w", err)
 	}
-	if !res.Success {
+	if !integration.IsXMLRPCSuccess(res) {
 		return errors.New("pfsense return 'false' as a result of exec php")
 	}
 	return nil
 }
 
-func (s *pfsenseService) endpointToHost(endpoint UnboundEndpoint) (host, error) {
-	if !slices.Contains([]string{"A", "TXT"}, endpoint.RecordType) {
-		return host{}, fmt.Errorf("only A and TXT record types are supported, got %+v", endpoint.RecordType)
+func (s *pfsenseService) endpointToHost(endpoint UnboundEndpoint, meta recordMetadata) (host, error) {
+	if !slices.Contains([]string{recordTypeA, recordTypeAAAA}, endpoint.RecordType) {
+		return host{}, fmt.Errorf("only A and AAAA record types are supported, got %+v", endpoint.RecordType)
 	}
 
 	hostname, domain, err := s.explodeHostName(endpoint.DNSName)
@@ -178,64 +725,158 @@ func (s *pfsenseService) endpointToHost(endpoint UnboundEndpoint) (host, error)
 		return host{}, fmt.Errorf("failed to explode dns name %+v; %w", endpoint.DNSName, err)
 	}
 
-	if endpoint.RecordType == "A" && len(endpoint.Targets) != 1 {
-		return host{}, fmt.Errorf("only one target is supported for A record, got %+v; dns name: %s", endpoint.Targets, endpoint.DNSName)
+	if len(endpoint.Targets) == 0 {
+		return host{}, fmt.Errorf("at least one target is required for %s record; dns name: %s", endpoint.RecordType, endpoint.DNSName)
 	}
 
-	ip := "127.0.0.1" // fake IP for non-A records
-	if endpoint.RecordType == "A" {
-		ip = endpoint.Targets[0]
-	}
+	// targets are kept sorted so reordered targets produce the very same host
+	endpoint.Targets = s.sortTargets(endpoint.Targets)
 
-	description, _ := json.Marshal(endpoint)
+	for _, target := range endpoint.Targets {
+		if err := s.validateAddress(endpoint.RecordType, target); err != nil {
+			return host{}, fmt.Errorf("invalid target for dns name %s; %w", endpoint.DNSName, err)
+		}
+	}
 
 	return host{
 		Host:   hostname,
 		Domain: domain,
-		Ip:     ip,
-		Descr:  base64.StdEncoding.EncodeToString(description),
+		// pfsense accepts a comma-separated list of addresses in a host override
+		Ip:    strings.Join(endpoint.Targets, ","),
+		Descr: s.encodeMetadata(endpoint, meta),
 	}, nil
 }
 
-func (s *pfsenseService) hostToEndpoint(host host) (UnboundEndpoint, error) {
+// hostToEndpoint converts a host override to an endpoint and returns its webhook metadata, which is nil
+// when the host was not created by the webhook.
+func (s *pfsenseService) hostToEndpoint(host host) (UnboundEndpoint, *recordMetadata, error) {
 	dnsName, err := s.buildDNSName(host.Host, host.Domain)
 	if err != nil {
-		return UnboundEndpoint{}, fmt.Errorf("failed to build dns name from host %+v; %w", host, err)
+		return UnboundEndpoint{}, nil, fmt.Errorf("failed to build dns name from host %+v; %w", host, err)
 	}
 
-	recordType := "A"
-	targets := []string{host.Ip}
-	var labels map[string]string
-	var providerSpecific map[string]string
-
 	if host.Descr != "" {
 		decoded, err := base64.StdEncoding.DecodeString(host.Descr)
-		if err != nil {
+		switch {
+		case err != nil:
 			slog.Warn("failed to decode base64 description", "descr", host.Descr, "dnsName", dnsName, "error", err)
-		} else {
-			var endpoint UnboundEndpoint
-			if err := json.Unmarshal(decoded, &endpoint); err != nil {
-				return UnboundEndpoint{}, fmt.Errorf("failed to unmarshal description %+v to endpoint; %w", host.Descr, err)
+		case !bytes.HasPrefix(bytes.TrimSpace(decoded), []byte("{")):
+			// short hand-written descriptions, e.g. "home", happen to be valid base64 too; only a json object
+			// can be webhook metadata, anything else is a host override made by hand
+			slog.Debug("description is not webhook metadata", "descr", host.Descr, "dnsName", dnsName)
+		default:
+			endpoint, meta, err := s.unmarshalMetadata(decoded)
+			if err != nil {
+				return UnboundEndpoint{}, nil, fmt.Errorf("failed to read description %+v; %w", host.Descr, err)
+			}
+			// the checksum covers the endpoint only, so metadata copied to another host override, or a host override
+			// renamed in pfsense gui, is caught by its name
+			if endpoint.key().DNSName != (UnboundEndpoint{DNSName: dnsName}).key().DNSName {
+				return UnboundEndpoint{}, nil, fmt.Errorf("metadata of host override %s belongs to %s", dnsName, endpoint.DNSName)
 			}
+			recordType := recordTypeA
 			if endpoint.RecordType != "" {
 				recordType = endpoint.RecordType
 			}
-			targets = endpoint.Targets
-			labels = endpoint.Labels
-			providerSpecific = endpoint.ProviderSpecific
+			endpoint = UnboundEndpoint{
+				DNSName:          dnsName,
+				Targets:          endpoint.Targets,
+				RecordType:       recordType,
+				RecordTTL:        endpoint.RecordTTL,
+				SetIdentifier:    endpoint.SetIdentifier,
+				Labels:           endpoint.Labels,
+				ProviderSpecific: endpoint.ProviderSpecific,
+			}
+			if s.storedAsHost(endpoint) {
+				// the addresses are read from the host override itself rather than from the metadata, so an address
+				// changed in pfsense gui is seen by external-dns and an update that expects the old one is refused
+				targets, err := s.hostAddresses(host, recordType)
+				if err != nil {
+					return UnboundEndpoint{}, nil, fmt.Errorf("failed to read addresses of host override %s; %w", dnsName, err)
+				}
+				endpoint.Targets = targets
+			}
+			endpoint.Targets = s.sortTargets(endpoint.Targets)
+			return endpoint, &meta, nil
 		}
 	}
 
-	return UnboundEndpoint{
-		DNSName:          dnsName,
-		Targets:          targets,
-		RecordType:       recordType,
-		Labels:           labels,
-		ProviderSpecific: providerSpecific,
-	}, nil
+	// a host override made by hand is a single A or AAAA record, so one that external-dns could not hold,
+	// e.g. with ipv4 and ipv6 addresses mixed, is not reported at all
+	endpoint, err := s.endpointFromHostFields(host)
+	if err != nil {
+		return UnboundEndpoint{}, nil, fmt.Errorf("failed to read host override made by hand; %w", err)
+	}
+	return endpoint, nil, nil
+}
+
+// hostAddresses returns the addresses of a host override, which should all fit the record type.
+func (s *pfsenseService) hostAddresses(h host, recordType string) ([]string, error) {
+	ips := s.splitHostIPs(h.Ip)
+	if len(ips) == 0 {
+		return nil, errors.New("host override has no ip address")
+	}
+	for _, ip := range ips {
+		if err := s.validateAddress(recordType, ip); err != nil {
+			return nil, fmt.Errorf("address does not fit %s record; %w", recordType, err)
+		}
+	}
+	return ips, nil
+}
+
+func (s *pfsenseService) splitHostIPs(ip string) []string {
+	var ips []string
+	for part := range strings.SplitSeq(ip, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			ips = append(ips, part)
+		}
+	}
+	return ips
+}
+
+func (s *pfsenseService) sortTargets(targets []string) []string {
+	sorted := integration.UniqueSlice(targets)
+	slices.Sort(sorted)
+	return sorted
 }
 
+func (s *pfsenseService) validateAddress(recordType string, target string) error {
+	addr, err := netip.ParseAddr(target)
+	if err != nil {
+		return fmt.Errorf("target %+v is not an ip address; %w", target, err)
+	}
+	if recordType == recordTypeA && !addr.Is4() {
+		return fmt.Errorf("target %+v is not an ipv4 address", target)
+	}
+	if recordType == recordTypeAAAA && (!addr.Is6() || addr.Is4In6()) {
+		return fmt.Errorf("target %+v is not an ipv6 address", target)
+	}
+	return nil
+}
+
+// addressRecordType guesses the record type of a host override that carries no metadata.
+func (s *pfsenseService) addressRecordType(ip string) string {
+	if addr, err := netip.ParseAddr(ip); err == nil && addr.Is6() && !addr.Is4In6() {
+		return recordTypeAAAA
+	}
+	return recordTypeA
+}
+
+// explodeHostName splits a dns name into the host and domain of a host override. When managed zones
+// are configured the name is split on the longest matching zone, otherwise on the first dot.
 func (s *pfsenseService) explodeHostName(hostName string) (string, string, error) {
+	if len(s.zones) > 0 {
+		zone, ok := s.findZone(hostName)
+		if !ok {
+			return "", "", fmt.Errorf("dns name %+v is outside of managed zones %+v", hostName, s.zones)
+		}
+		name := strings.TrimSuffix(hostName, ".")
+		host := strings.TrimSuffix(name[:len(name)-len(zone)], ".")
+		if host != "" && !s.isDomainName(host) {
+			return "", "", fmt.Errorf("host %+v is not allowed by pfsense", host)
+		}
+		return host, zone, nil
+	}
 	if strings.Count(hostName, ".") == 1 {
 		return "", hostName, nil
 	}
@@ -247,8 +888,8 @@ func (s *pfsenseService) explodeHostName(hostName string) (string, string, error
 }
 
 func (s *pfsenseService) buildDNSName(host, domain string) (string, error) {
-	if strings.Count(host, ".") != 0 {
-		return "", fmt.Errorf("host can have only one part, got %+v", strings.Split(host, "."))
+	if domain == "" {
+		return "", fmt.Errorf("domain is required, got host %+v without domain", host)
 	}
 	var name string
 	if host != "" {
@@ -259,71 +900,53 @@ func (s *pfsenseService) buildDNSName(host, domain string) (string, error) {
 	return name, nil
 }
 
+// findZone returns the longest managed zone the dns name belongs to, as it is spelled in the name.
+func (s *pfsenseService) findZone(dnsName string) (string, bool) {
+	name := strings.TrimSuffix(dnsName, ".")
+	// zones are sorted from the longest to the shortest, so the first match is the longest one
+	for _, zone := range s.zones {
+		if len(name) < len(zone) {
+			continue
+		}
+		suffix := name[len(name)-len(zone):]
+		if strings.EqualFold(suffix, zone) && (len(name) == len(zone) || name[len(name)-len(zone)-1] == '.') {
+			return suffix, true
+		}
+	}
+	return "", false
+}
+
+// inManagedZones reports whether the dns name is managed by the webhook; any name is managed when no zones are configured.
+func (s *pfsenseService) inManagedZones(dnsName string) bool {
+	if len(s.zones) == 0 {
+		return true
+	}
+	_, ok := s.findZone(dnsName)
+	return ok
+}
+
 type UnboundEndpoint struct {
 	DNSName          string            `json:"dnsName"`
 	Targets          []string          `json:"targets,omitempty"`
 	Labels           map[string]string `json:"labels,omitempty"`
 	RecordType       string            `json:"recordType"`
+	RecordTTL        int64             `json:"recordTTL,omitempty"`
+	SetIdentifier    string            `json:"setIdentifier,omitempty"`
 	ProviderSpecific map[string]string `json:"providerSpecific,omitempty"`
 }
 
-type unboundStruct struct {
-	Unbound unbound `xml:"unbound"`
-}
-
-//nolint:revive,staticcheck
-type unbound struct {
-	Enable                    string `xml:"enable"`
-	Dnssec                    string `xml:"dnssec"`
-	ActiveInterface           string `xml:"active_interface"`
-	OutgoingInterface         string `xml:"outgoing_interface"`
-	CustomOptions             string `xml:"custom_options"`
-	Hideidentity              string `xml:"hideidentity"`
-	Hideversion               string `xml:"hideversion"`
-	Dnssecstripped            string `xml:"dnssecstripped"`
-	Hosts                     []host `xml:"hosts"`
-	Acls                      []acl  `xml:"acls"`
-	Port                      string `xml:"port"`
-	Tlsport                   string `xml:"tlsport"`
-	Sslcertref                string `xml:"sslcertref"`
-	SystemDomainLocalZoneType string `xml:"system_domain_local_zone_type"`
-	Msgcachesize              string `xml:"msgcachesize"`
-	OutgoingNumTcp            string `xml:"outgoing_num_tcp"`
-	IncomingNumTcp            string `xml:"incoming_num_tcp"`
-	EdnsBufferSize            string `xml:"edns_buffer_size"`
-	NumQueriesPerThread       string `xml:"num_queries_per_thread"`
-	JostleTimeout             string `xml:"jostle_timeout"`
-	CacheMaxTtl               string `xml:"cache_max_ttl"`
-	CacheMinTtl               string `xml:"cache_min_ttl"`
-	InfraKeepProbing          string `xml:"infra_keep_probing"`
-	InfraHostTtl              string `xml:"infra_host_ttl"`
-	InfraCacheNumhosts        string `xml:"infra_cache_numhosts"`
-	UnwantedReplyThreshold    string `xml:"unwanted_reply_threshold"`
-	LogVerbosity              string `xml:"log_verbosity"`
-	Forwarding                string `xml:"forwarding"`
-}
-
-//nolint:revive,staticcheck
-type host struct {
-	Host    string `xml:"host"`
-	Domain  string `xml:"domain"`
-	Ip      string `xml:"ip"`
-	Descr   string `xml:"descr"`
-	Aliases string `xml:"aliases"`
-}
-
-//nolint:revive,staticcheck
-type acl struct {
-	Aclid       string   `xml:"aclid"`
-	Aclname     string   `xml:"aclname"`
-	Aclaction   string   `xml:"aclaction"`
-	Description string   `xml:"description"`
-	Row         []aclRow `xml:"row"`
-}
-
-//nolint:revive,staticcheck
-type aclRow struct {
-	AclNetwork  string `xml:"acl_network"`
-	Mask        string `xml:"mask"`
-	Description string `xml:"description"`
+// recordKey identifies a record. Several records may share a name as long as their type or set identifier differ,
+// e.g. an A record and its external-dns TXT registry record.
+type recordKey struct {
+	DNSName       string
+	RecordType    string
+	SetIdentifier string
+}
+
+func (e UnboundEndpoint) key() recordKey {
+	return recordKey{
+		DNSName:       strings.ToLower(strings.TrimSuffix(e.DNSName, ".")),
+		RecordType:    strings.ToUpper(e.RecordType),
+		SetIdentifier: e.SetIdentifier,
+	}
 }
@@ -0,0 +1,653 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_store_aaaa_records_next_to_a_records(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	for _, target := range []string{"10.0.0.20", "::ffff:10.0.0.20", "fd00::zz"} {
+		_, err := s.endpointToHost(UnboundEndpoint{DNSName: "app.example.com", Targets: []string{target}, RecordType: recordTypeAAAA}, recordMetadata{})
+		require.Error(t, err, target)
+	}
+	_, err := s.endpointToHost(UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"fd00::10"}, RecordType: recordTypeA}, recordMetadata{})
+	require.Error(t, err)
+
+	aaaa := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"fd00::10"}, RecordType: recordTypeAAAA}
+	h, err := s.endpointToHost(aaaa, recordMetadata{})
+	require.NoError(t, err)
+	require.Equal(t, "fd00::10", h.Ip)
+	endpoint, meta, err := s.hostToEndpoint(h)
+	require.NoError(t, err)
+	require.NotNil(t, meta)
+	require.Equal(t, aaaa, endpoint)
+
+	// the a record of the same name is a different record
+	record := unboundRecord{endpoint: endpoint, host: &h}
+	require.True(t, record.matches(aaaa))
+	require.False(t, record.matches(UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10"}, RecordType: recordTypeA}))
+
+	// a hand-made host override with an ipv6 address is reported as AAAA
+	endpoint, meta, err = s.hostToEndpoint(host{Host: "printer", Domain: "home.arpa", Ip: "fd00::20"})
+	require.NoError(t, err)
+	require.Nil(t, meta)
+	require.Equal(t, UnboundEndpoint{DNSName: "printer.home.arpa", Targets: []string{"fd00::20"}, RecordType: recordTypeAAAA}, endpoint)
+
+	// mixed addresses are neither an A nor an AAAA record
+	_, _, err = s.hostToEndpoint(host{Host: "printer", Domain: "home.arpa", Ip: "10.0.0.20,fd00::20"})
+	require.ErrorContains(t, err, "mixes ipv4 and ipv6 addresses")
+}
+
+func Test_should_store_multiple_targets_sorted(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	h, err := s.endpointToHost(UnboundEndpoint{DNSName: "lb.example.com", Targets: []string{"10.0.0.32", "10.0.0.30", "10.0.0.31", "10.0.0.30"}, RecordType: recordTypeA}, recordMetadata{})
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.30,10.0.0.31,10.0.0.32", h.Ip)
+
+	// reordered targets produce the very same host override
+	reordered, err := s.endpointToHost(UnboundEndpoint{DNSName: "lb.example.com", Targets: []string{"10.0.0.31", "10.0.0.32", "10.0.0.30"}, RecordType: recordTypeA}, recordMetadata{})
+	require.NoError(t, err)
+	require.Equal(t, h, reordered)
+
+	// a hand-made list is read back in the same order, whatever order it was typed in
+	endpoint, _, err := s.hostToEndpoint(host{Host: "lb", Domain: "home.arpa", Ip: "192.168.1.12, 192.168.1.10,192.168.1.11"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.168.1.10", "192.168.1.11", "192.168.1.12"}, endpoint.Targets)
+
+	_, err = s.endpointToHost(UnboundEndpoint{DNSName: "lb.example.com", Targets: []string{"10.0.0.30", "fd00::30"}, RecordType: recordTypeA}, recordMetadata{})
+	require.Error(t, err)
+}
+
+func Test_should_render_records_with_ttl_as_local_data(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	var validationErr *integration.ValidationError
+	require.ErrorAs(t, s.validateEndpoints([]UnboundEndpoint{{DNSName: "failover.example.com", Targets: []string{"10.0.0.40"}, RecordType: recordTypeA, RecordTTL: -1}}), &validationErr)
+
+	// host overrides cannot carry a ttl, so the record is served from custom options instead
+	failover := UnboundEndpoint{DNSName: "failover.example.com", Targets: []string{"10.0.0.40"}, RecordType: recordTypeA, RecordTTL: 30}
+	section := unbound{&integration.XMLRPCStruct{}}
+	require.NoError(t, s.writeRecords(section, []unboundRecord{{endpoint: failover}}))
+	hosts, err := section.hosts()
+	require.NoError(t, err)
+	require.Empty(t, hosts)
+	decoded, err := base64.StdEncoding.DecodeString(section.customOptions())
+	require.NoError(t, err)
+	require.Contains(t, string(decoded), `local-data: "failover.example.com. 30 IN A 10.0.0.40"`)
+
+	// the stored ttl is reported back, so external-dns does not see a diff
+	records, err := s.readRecords(section)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, failover, records[0].endpoint)
+}
+
+func Test_should_split_names_on_longest_managed_zone(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{Zones: []string{"Example.com.", "dev.example.com", " "}})
+	require.Equal(t, []string{"dev.example.com", "example.com"}, s.zones)
+
+	for name, expected := range map[string][2]string{
+		"app.dev.example.com":  {"app", "dev.example.com"},
+		"dev.example.com":      {"", "dev.example.com"},
+		"app.test.example.com": {"app.test", "example.com"},
+		"App.Example.COM":      {"App", "Example.COM"},
+	} {
+		host, domain, err := s.explodeHostName(name)
+		require.NoError(t, err, name)
+		require.Equal(t, expected, [2]string{host, domain}, name)
+	}
+	_, _, err := s.explodeHostName("app.example.org")
+	require.ErrorContains(t, err, "outside of managed zones")
+	require.Error(t, s.validateEndpoints([]UnboundEndpoint{{DNSName: "app.example.org", Targets: []string{"10.0.0.1"}, RecordType: recordTypeA}}))
+
+	// without zones the name is split on its first dot
+	s = newTestService(t, nil, PfsenseOptions{})
+	host, domain, err := s.explodeHostName("app.dev.example.com")
+	require.NoError(t, err)
+	require.Equal(t, [2]string{"app", "dev.example.com"}, [2]string{host, domain})
+}
+
+func Test_should_key_records_on_name_type_and_set_identifier(t *testing.T) {
+	t.Parallel()
+
+	require.Equal(t, UnboundEndpoint{DNSName: "App.Example.com.", RecordType: "a"}.key(), UnboundEndpoint{DNSName: "app.example.com", RecordType: recordTypeA}.key())
+	require.NotEqual(t, UnboundEndpoint{DNSName: "app.example.com", RecordType: recordTypeA}.key(), UnboundEndpoint{DNSName: "app.example.com", RecordType: recordTypeTXT}.key())
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	app := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}
+	blue := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.50"}, RecordType: recordTypeA, SetIdentifier: "blue"}
+	registry := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"\"heritage=external-dns\""}, RecordType: recordTypeTXT}
+
+	// records of the same name but another type or set identifier are stored side by side
+	section := unbound{&integration.XMLRPCStruct{}}
+	require.NoError(t, s.writeRecords(section, []unboundRecord{{endpoint: app}, {endpoint: blue}, {endpoint: registry}}))
+	hosts, err := section.hosts()
+	require.NoError(t, err)
+	require.Len(t, hosts, 2)
+	records, err := s.readRecords(section)
+	require.NoError(t, err)
+	endpoints := integration.MapSlice(records, func(record unboundRecord) UnboundEndpoint {
+		return record.endpoint
+	})
+	require.Equal(t, []UnboundEndpoint{app, blue, registry}, endpoints)
+	require.True(t, records[1].matches(UnboundEndpoint{DNSName: "app.example.com", RecordType: recordTypeA, SetIdentifier: "blue"}))
+	require.False(t, records[1].matches(app))
+}
+
+func Test_should_delete_only_matching_records_created_by_webhook(t *testing.T) {
+	t.Parallel()
+
+	s := newTestService(t, nil, PfsenseOptions{})
+	app := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}
+	nas := UnboundEndpoint{DNSName: "nas.home.arpa", Targets: []string{"192.168.1.5"}, RecordType: recordTypeA}
+	records := []unboundRecord{{endpoint: app, managed: true}, {endpoint: nas}}
+
+	// nas.home.arpa is made by hand, so it is not deleted
+	_, err := s.verifyDeletions(records, []UnboundEndpoint{nas})
+	require.True(t, integration.IsResourceConflictError(err), err)
+	// the stored targets differ from the requested ones
+	_, err = s.verifyDeletions(records, []UnboundEndpoint{{DNSName: "app.example.com", Targets: []string{"10.0.0.10"}, RecordType: recordTypeA}})
+	require.True(t, integration.IsResourceConflictError(err), err)
+
+	deleted, err := s.verifyDeletions(records, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.11", "10.0.0.10"}, RecordType: recordTypeA},
+		// a record that is already gone is not an error
+		{DNSName: "gone.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false}, deleted)
+}
+
+func Test_should_leave_hand_made_host_overrides_alone_in_managed_mode(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewPfsenseService(nil, PfsenseOptions{OwnershipMode: "mine", ValidationMode: validationModeStrict, Audit: NewNoopAuditLog()})
+	require.Error(t, err)
+
+	s := newTestService(t, nil, PfsenseOptions{OwnershipMode: ownershipModeManaged})
+	app := UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10"}, RecordType: recordTypeA}
+	nas := UnboundEndpoint{DNSName: "nas.example.com", Targets: []string{"192.168.1.5"}, RecordType: recordTypeA}
+	records := []unboundRecord{{endpoint: app, managed: true}, {endpoint: nas}}
+
+	// a name held by a hand-made host override cannot be taken over, whatever the record type
+	err = s.verifyOwnership(records, []UnboundEndpoint{{DNSName: "NAS.example.com", Targets: []string{"fd00::5"}, RecordType: recordTypeAAAA}})
+	require.True(t, integration.IsResourceConflictError(err), err)
+	require.NoError(t, s.verifyOwnership(records, []UnboundEndpoint{app, {DNSName: "new.example.com", Targets: []string{"10.0.0.11"}, RecordType: recordTypeA}}))
+}
+
+func Test_should_restore_fetched_unbound_section_unchanged(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	section, err := s.fetchUnboundSection(t.Context())
+	require.NoError(t, err)
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	require.NoError(t, err)
+	require.NoError(t, s.writeRecords(section, records))
+	require.NoError(t, s.saveUnboundSection(t.Context(), section, fingerprint))
+
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	// the raw xml is compared, so members that are reordered or re-typed are caught as well
+	require.Equal(t, unboundXML(t, backup), unboundXML(t, restores[0]))
+}
+
+func Test_should_roll_back_to_snapshot_when_reload_fails(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	// the first reload and its retry fail, the reload after the rollback succeeds
+	pfsense.failedExecs = 2
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	section, err := s.fetchUnboundSection(t.Context())
+	require.NoError(t, err)
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	require.NoError(t, err)
+	records = append(records, unboundRecord{endpoint: UnboundEndpoint{DNSName: "new.example.com", Targets: []string{"10.0.0.20"}, RecordType: recordTypeA}, managed: true})
+	require.NoError(t, s.writeRecords(section, records))
+
+	err = s.saveUnboundSection(t.Context(), section, fingerprint)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rolled back to snapshot")
+
+	restores := pfsense.restores()
+	require.Len(t, restores, 2)
+	require.NotEqual(t, unboundXML(t, backup), unboundXML(t, restores[0]))
+	require.Equal(t, unboundXML(t, backup), unboundXML(t, restores[1]))
+}
+
+func Test_should_refuse_to_overwrite_concurrently_changed_section(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	section, err := s.fetchUnboundSection(t.Context())
+	require.NoError(t, err)
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	require.NoError(t, err)
+	require.NoError(t, s.writeRecords(section, records))
+
+	// somebody changes a host override in pfsense gui meanwhile
+	pfsense.setBackup(bytes.Replace(backup, []byte("192.168.1.5"), []byte("192.168.1.6"), 1))
+
+	err = s.saveUnboundSection(t.Context(), section, fingerprint)
+	require.ErrorIs(t, err, errSectionChanged)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_refuse_changes_over_safety_limits(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{SafetyLimits: SafetyLimits{
+		MaxDeletions:   1,
+		ProtectedNames: []string{"*.home.arpa"},
+	}})
+
+	toDelete := []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA},
+		{DNSName: "www.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME},
+	}
+	err = s.ApplyChanges(t.Context(), nil, nil, nil, toDelete)
+	require.True(t, integration.IsPolicyViolationError(err), err)
+	// a plan runs the same limits
+	_, err = s.PlanChanges(t.Context(), nil, nil, nil, toDelete)
+	require.True(t, integration.IsPolicyViolationError(err), err)
+
+	err = s.ApplyChanges(t.Context(), nil, nil, []UnboundEndpoint{
+		{DNSName: "nas.home.arpa", Targets: []string{"192.168.1.6"}, RecordType: recordTypeA},
+	}, nil)
+	require.True(t, integration.IsPolicyViolationError(err), err)
+
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_refuse_update_of_record_changed_since_it_was_read(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	err = s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.9"}, RecordType: recordTypeA},
+	}, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+	}, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+
+	err = s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{
+		{DNSName: "gone.example.com", Targets: []string{"10.0.0.9"}, RecordType: recordTypeA},
+	}, []UnboundEndpoint{
+		{DNSName: "gone.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+	}, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_refuse_update_of_host_whose_ip_was_changed_in_gui(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	// the metadata still holds the addresses the webhook wrote, the ip is what the gui changed it to
+	edited := bytes.Replace(backup, []byte("<string>10.0.0.10,10.0.0.11</string>"), []byte("<string>10.0.0.20</string>"), 1)
+	pfsense := newFakePfsense(t, edited)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.20"}, RecordType: recordTypeA})
+
+	// external-dns read the record before the edit
+	err = s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA},
+	}, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+	}, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_rename_record_in_place(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	err = s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{
+		{DNSName: "app.example.com", Targets: []string{"10.0.0.11", "10.0.0.10"}, RecordType: recordTypeA},
+	}, []UnboundEndpoint{
+		{DNSName: "api.example.com", Targets: []string{"10.0.0.12"}, RecordType: recordTypeA},
+	}, nil)
+	require.NoError(t, err)
+
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	section, ok := unboundValue(t, restores[0]).(map[string]any)
+	require.True(t, ok)
+	hosts, ok := section[unboundHostsKey].([]any)
+	require.True(t, ok)
+	names := integration.MapSlice(hosts, func(h any) any {
+		return h.(map[string]any)["host"]
+	})
+	require.Equal(t, []any{"string:api", "string:nas"}, names)
+	// the aliases of an untouched host override stay nested under it
+	aliases := hosts[1].(map[string]any)["aliases"]
+	require.Equal(t, map[string]any{"item": []any{
+		map[string]any{"host": "string:files", "domain": "string:home.arpa", "description": "string:smb share"},
+	}}, aliases)
+}
+
+func Test_should_keep_host_aliases_on_update(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	pfsense := newFakePfsense(t, backup)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	err = s.ApplyChanges(t.Context(), nil, []UnboundEndpoint{
+		{DNSName: "nas.home.arpa", Targets: []string{"192.168.1.5"}, RecordType: recordTypeA},
+	}, []UnboundEndpoint{
+		{DNSName: "nas.home.arpa", Targets: []string{"192.168.1.6"}, RecordType: recordTypeA},
+	}, nil)
+	require.NoError(t, err)
+
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	section, ok := unboundValue(t, restores[0]).(map[string]any)
+	require.True(t, ok)
+	hosts, ok := section[unboundHostsKey].([]any)
+	require.True(t, ok)
+	nas := hosts[1].(map[string]any)
+	require.Equal(t, "string:192.168.1.6", nas["ip"])
+	require.Equal(t, map[string]any{"item": []any{
+		map[string]any{"host": "string:files", "domain": "string:home.arpa", "description": "string:smb share"},
+	}}, nas["aliases"])
+}
+
+func Test_should_skip_invalid_endpoints_only_in_lenient_mode(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	toCreate := []UnboundEndpoint{
+		{DNSName: "new.example.com", Targets: []string{"10.0.0.20"}, RecordType: recordTypeA},
+		{DNSName: "bad.example.com", Targets: []string{"not an ip"}, RecordType: recordTypeA},
+		{DNSName: "ns.example.com", Targets: []string{"ns1.example.com"}, RecordType: "NS"},
+		{DNSName: "app.example.org", Targets: []string{"10.0.0.21"}, RecordType: recordTypeA},
+	}
+
+	domainFilters := DomainFilters{Filters: []string{"example.com"}}
+
+	strict := newFakePfsense(t, backup)
+	s := newTestService(t, strict.client, PfsenseOptions{DomainFilters: domainFilters})
+	err = s.ApplyChanges(t.Context(), toCreate, nil, nil, nil)
+	var validationErr *integration.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.Len(t, validationErr.Params(), 3)
+	require.Equal(t, "create[1]", validationErr.Params()[0].Name)
+	require.Equal(t, "create[2]", validationErr.Params()[1].Name)
+	require.Equal(t, "create[3]", validationErr.Params()[2].Name)
+	require.Empty(t, strict.restores())
+
+	lenient := newFakePfsense(t, backup)
+	s = newTestService(t, lenient.client, PfsenseOptions{ValidationMode: validationModeLenient, DomainFilters: domainFilters})
+	// the plan shows the valid changes together with the endpoints it skips
+	plan, err := s.PlanChanges(t.Context(), toCreate, nil, nil, nil)
+	require.NoError(t, err)
+	require.Len(t, plan.HostsAdded, 1)
+	require.Equal(t, "10.0.0.20", plan.HostsAdded[0].Ip)
+	require.Equal(t, []string{"create[1]", "create[2]", "create[3]"}, integration.MapSlice(plan.Skipped, func(skipped SkippedEndpoint) string {
+		return skipped.Name
+	}))
+	require.Equal(t, toCreate[3], plan.Skipped[2].Endpoint)
+	require.Contains(t, plan.Skipped[2].Reason, "outside of domain filters")
+	require.Empty(t, lenient.restores())
+
+	// the valid changes are applied and the skipped endpoints are still reported
+	err = s.ApplyChanges(t.Context(), toCreate, nil, nil, nil)
+	require.ErrorAs(t, err, &validationErr)
+	require.Len(t, validationErr.Params(), 3)
+	restores := lenient.restores()
+	require.Len(t, restores, 1)
+	require.Contains(t, string(restores[0]), "10.0.0.20")
+	require.NotContains(t, string(restores[0]), "<string>bad</string>")
+}
+
+// newTestService builds the service the way the app does, filling in the options a test does not care about.
+func newTestService(t *testing.T, client *integration.XMLRPCClient, opts PfsenseOptions) *pfsenseService {
+	t.Helper()
+	if opts.OwnershipMode == "" {
+		opts.OwnershipMode = ownershipModeAll
+	}
+	if opts.ValidationMode == "" {
+		opts.ValidationMode = validationModeStrict
+	}
+	if opts.OwnerID == "" {
+		opts.OwnerID = "default"
+	}
+	if opts.Audit == nil {
+		opts.Audit = NewNoopAuditLog()
+	}
+	service, err := NewPfsenseService(client, opts)
+	require.NoError(t, err)
+	s, ok := service.(*pfsenseService)
+	require.True(t, ok)
+	return s
+}
+
+// fakePfsense serves the xml-rpc methods used by the service and records the restored sections.
+type fakePfsense struct {
+	client      *integration.XMLRPCClient
+	failedExecs int
+
+	mu       sync.Mutex
+	backup   []byte
+	restored [][]byte
+}
+
+func newFakePfsense(t *testing.T, backup []byte) *fakePfsense {
+	t.Helper()
+	pfsense := &fakePfsense{backup: backup}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read xml-rpc request; %v", err)
+			return
+		}
+		var call struct {
+			MethodName string `xml:"methodName"`
+		}
+		if err := xml.Unmarshal(body, &call); err != nil {
+			t.Errorf("failed to unmarshal xml-rpc request; %v", err)
+			return
+		}
+		pfsense.mu.Lock()
+		defer pfsense.mu.Unlock()
+		switch call.MethodName {
+		case "pfsense.backup_config_section":
+			_, _ = w.Write(pfsense.backup)
+		case "pfsense.restore_config_section":
+			pfsense.restored = append(pfsense.restored, body)
+			_, _ = w.Write([]byte(successResponse))
+		case "pfsense.exec_php":
+			if pfsense.failedExecs > 0 {
+				pfsense.failedExecs--
+				_, _ = w.Write([]byte(failureResponse))
+				return
+			}
+			_, _ = w.Write([]byte(successResponse))
+		default:
+			t.Errorf("unexpected method %s", call.MethodName)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	pfsense.client = integration.NewXMLRPCClient(server.URL, server.Client(), nil)
+	return pfsense
+}
+
+func (p *fakePfsense) setBackup(backup []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.backup = backup
+}
+
+func (p *fakePfsense) restores() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.restored)
+}
+
+const (
+	successResponse = `<?xml version="1.0"?><methodResponse><params><param><value><boolean>1</boolean></value></param></params></methodResponse>`
+	failureResponse = `<?xml version="1.0"?><methodResponse><params><param><value><boolean>0</boolean></value></param></params></methodResponse>`
+)
+
+// unboundValue returns the unbound section of a backup response or a restore request.
+func unboundValue(t *testing.T, message []byte) any {
+	t.Helper()
+	var call struct {
+		Params []xmlrpcValue `xml:"params>param>value"`
+	}
+	require.NoError(t, xml.Unmarshal(message, &call))
+	require.NotEmpty(t, call.Params)
+	sections, ok := call.Params[0].canonical().(map[string]any)
+	require.True(t, ok)
+	require.NotNil(t, sections[unboundConfigSection])
+	return sections[unboundConfigSection]
+}
+
+// unboundXML returns the raw xml of the unbound section of a backup response or a restore request.
+func unboundXML(t *testing.T, message []byte) string {
+	t.Helper()
+	var call struct {
+		Members []struct {
+			Name  string `xml:"name"`
+			Value struct {
+				XML string `xml:",innerxml"`
+			} `xml:"value"`
+		} `xml:"params>param>value>struct>member"`
+	}
+	require.NoError(t, xml.Unmarshal(message, &call))
+	for _, member := range call.Members {
+		if member.Name == unboundConfigSection {
+			return member.Value.XML
+		}
+	}
+	require.Failf(t, "unbound section not found", "%s", message)
+	return ""
+}
+
+// hostDescr returns the description of the named host override in a backup response or a restore request.
+func hostDescr(t *testing.T, message []byte, name string) string {
+	t.Helper()
+	section, ok := unboundValue(t, message).(map[string]any)
+	require.True(t, ok)
+	hosts, ok := section[unboundHostsKey].([]any)
+	require.True(t, ok)
+	for _, h := range hosts {
+		fields := h.(map[string]any)
+		if fields["host"] == "string:"+name {
+			descr, _ := fields["descr"].(string)
+			return strings.TrimPrefix(descr, "string:")
+		}
+	}
+	require.Failf(t, "host override not found", "host %s", name)
+	return ""
+}
+
+// xmlrpcValue is a raw xml-rpc value, it is compared independently of the member order and whitespace.
+type xmlrpcValue struct {
+	Struct *struct {
+		Members []struct {
+			Name  string      `xml:"name"`
+			Value xmlrpcValue `xml:"value"`
+		} `xml:"member"`
+	} `xml:"struct"`
+	Array *struct {
+		Values []xmlrpcValue `xml:"data>value"`
+	} `xml:"array"`
+	Scalar *struct {
+		XMLName xml.Name
+		Text    string `xml:",chardata"`
+	} `xml:",any"`
+	Text string `xml:",chardata"`
+}
+
+func (v xmlrpcValue) canonical() any {
+	switch {
+	case v.Struct != nil:
+		members := map[string]any{}
+		for _, member := range v.Struct.Members {
+			members[member.Name] = member.Value.canonical()
+		}
+		return members
+	case v.Array != nil:
+		values := make([]any, 0, len(v.Array.Values))
+		for _, value := range v.Array.Values {
+			values = append(values, value.canonical())
+		}
+		return values
+	case v.Scalar != nil:
+		name := v.Scalar.XMLName.Local
+		if name == "i4" {
+			name = "int"
+		}
+		return name + ":" + v.Scalar.Text
+	default:
+		// a value without a type is a string
+		return "string:" + strings.TrimSpace(v.Text)
+	}
+}
+
+// customOptionsOf returns the custom options of the unbound section in a backup or restore message.
+func customOptionsOf(t *testing.T, message []byte) string {
+	t.Helper()
+	section, ok := unboundValue(t, message).(map[string]any)
+	require.True(t, ok)
+	customOptions, ok := section[unboundCustomOptionsKey].(string)
+	require.True(t, ok)
+	return strings.TrimPrefix(customOptions, "string:")
+}
@@ -0,0 +1,140 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// Plan is what applying changes would do to the unbound section.
+type Plan struct {
+	HostsAdded           []HostOverride
+	HostsModified        []HostOverrideModification
+	HostsRemoved         []HostOverride
+	CustomOptionsAdded   []string
+	CustomOptionsRemoved []string
+	// Reloads are the services reloaded after the section is restored
+	Reloads []string
+	// Skipped are the invalid endpoints lenient validation leaves out of the changes
+	Skipped []SkippedEndpoint
+}
+
+//nolint:revive,staticcheck
+type HostOverride struct {
+	Host   string
+	Domain string
+	Ip     string
+	Descr  string
+}
+
+type HostOverrideModification struct {
+	Before HostOverride
+	After  HostOverride
+}
+
+// PlanChanges runs the same checks and merge as ApplyChanges but never writes anything to pfsense.
+func (s *pfsenseService) PlanChanges(ctx context.Context, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (Plan, error) {
+	filters, err := s.DomainFilters(ctx)
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to resolve domain filters; %w", err)
+	}
+	// in lenient mode the plan shows what the valid changes would do, like ApplyChanges applies them, together
+	// with the skipped endpoints; nothing is counted nor logged, since nothing is applied
+	valid, skipped, err := s.checkEndpoints(filters, toCreate, toUpdateOld, toUpdate, toDelete)
+	if err != nil {
+		return Plan{}, err
+	}
+	merged, err := s.merge(ctx, valid.toCreate, valid.toUpdateOld, valid.toUpdate, valid.toDelete)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan, err := s.buildPlan(merged.original, merged.section)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.Skipped = append(plan.Skipped, skipped...)
+	return plan, nil
+}
+
+func (s *pfsenseService) buildPlan(original unbound, section unbound) (Plan, error) {
+	plan := Plan{
+		HostsAdded:           []HostOverride{},
+		HostsModified:        []HostOverrideModification{},
+		HostsRemoved:         []HostOverride{},
+		CustomOptionsAdded:   []string{},
+		CustomOptionsRemoved: []string{},
+		Reloads:              []string{},
+		Skipped:              []SkippedEndpoint{},
+	}
+	if original.fingerprint() == section.fingerprint() {
+		return plan, nil
+	}
+
+	before, err := original.hosts()
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to read original host overrides; %w", err)
+	}
+	after, err := section.hosts()
+	if err != nil {
+		return Plan{}, fmt.Errorf("failed to read final host overrides; %w", err)
+	}
+	removed, added := diffItems(integration.MapSlice(before, toHostOverride), integration.MapSlice(after, toHostOverride))
+	// a host override that is removed and added with the same name is a modification
+	for _, host := range added {
+		index := slices.IndexFunc(removed, func(candidate HostOverride) bool {
+			return candidate.Host == host.Host && candidate.Domain == host.Domain
+		})
+		if index == -1 {
+			plan.HostsAdded = append(plan.HostsAdded, host)
+			continue
+		}
+		plan.HostsModified = append(plan.HostsModified, HostOverrideModification{Before: removed[index], After: host})
+		removed = append(removed[:index], removed[index+1:]...)
+	}
+	plan.HostsRemoved = append(plan.HostsRemoved, removed...)
+
+	plan.CustomOptionsRemoved, plan.CustomOptionsAdded = diffItems(s.customOptionsLines(original.customOptions()), s.customOptionsLines(section.customOptions()))
+
+	for _, step := range reloadSteps {
+		plan.Reloads = append(plan.Reloads, step.name)
+	}
+	return plan, nil
+}
+
+func toHostOverride(h host) HostOverride {
+	return HostOverride{Host: h.Host, Domain: h.Domain, Ip: h.Ip, Descr: h.Descr}
+}
+
+func (s *pfsenseService) customOptionsLines(raw string) []string {
+	return integration.FilterSlice(strings.Split(s.decodeCustomOptions(raw), "\n"), func(line string) bool {
+		return strings.TrimSpace(line) != ""
+	})
+}
+
+// diffItems returns the items that are only in before and the ones that are only in after;
+// repeated items are matched one to one.
+func diffItems[T comparable](before []T, after []T) ([]T, []T) {
+	counts := make(map[T]int, len(before))
+	for _, item := range before {
+		counts[item]++
+	}
+	added := []T{}
+	for _, item := range after {
+		if counts[item] > 0 {
+			counts[item]--
+			continue
+		}
+		added = append(added, item)
+	}
+	removed := []T{}
+	for _, item := range before {
+		if counts[item] > 0 {
+			counts[item]--
+			removed = append(removed, item)
+		}
+	}
+	return removed, added
+}
@@ -0,0 +1,208 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+// QuarantinedRecord is a host override or a record in the managed block of custom options that cannot be read
+// as a record, e.g. after its metadata was edited by hand. It is not reported to external-dns until it is repaired
+// or fixed in pfsense.
+//
+//nolint:revive,staticcheck
+type QuarantinedRecord struct {
+	Host   string `json:"host"`
+	Domain string `json:"domain"`
+	Ip     string `json:"ip"`
+	Descr  string `json:"descr"`
+	// Record is the text of a record in the managed block of custom options; it is empty for host overrides
+	Record string `json:"record,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// QuarantinedRecords returns the host overrides and the managed records of custom options that cannot be read as records.
+func (s *pfsenseService) QuarantinedRecords(ctx context.Context) ([]QuarantinedRecord, error) {
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	records, err := s.readRecords(section)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unbound records; %w", err)
+	}
+	quarantined := []QuarantinedRecord{}
+	for _, record := range records {
+		if s.quarantined(record) {
+			quarantined = append(quarantined, s.toQuarantinedRecord(record))
+		}
+	}
+	return quarantined, nil
+}
+
+// RepairQuarantinedRecords rewrites the metadata of the quarantined host overrides from their host, domain and ip,
+// so they are reported to external-dns again. Hosts that cannot be repaired, e.g. without a valid address, stay
+// quarantined, so do the records of custom options, which have nothing but their metadata to be rebuilt from.
+// The repaired records are returned.
+func (s *pfsenseService) RepairQuarantinedRecords(ctx context.Context) ([]QuarantinedRecord, error) {
+	section, err := s.fetchUnboundSection(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch unbound section; %w", err)
+	}
+	original := section.clone()
+	fingerprint := section.fingerprint()
+	records, err := s.readRecords(section)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unbound records; %w", err)
+	}
+
+	repaired := []QuarantinedRecord{}
+	var changes []recordChange
+	for i, record := range records {
+		if !s.quarantined(record) || record.host == nil {
+			continue
+		}
+		endpoint, err := s.endpointFromHostFields(*record.host)
+		if err != nil {
+			slog.WarnContext(ctx, "cannot repair quarantined host override", slog.String("host", record.host.Host),
+				slog.String("domain", record.host.Domain), slog.Any("err", err))
+			continue
+		}
+		repaired = append(repaired, s.toQuarantinedRecord(record))
+		h := *record.host
+		h.Descr = s.encodeMetadata(endpoint, recordMetadata{ownerID: s.ownerID})
+		records[i] = unboundRecord{endpoint: endpoint, host: &h, managed: true}
+		changes = append(changes, recordChange{Action: changeActionUpdate, After: &endpoint})
+	}
+	if len(repaired) == 0 {
+		return repaired, nil
+	}
+
+	if err := s.writeRecords(section, records); err != nil {
+		return nil, fmt.Errorf("failed to write unbound records; %w", err)
+	}
+
+	if s.dryRun {
+		slog.InfoContext(ctx, "dry run enabled, not repairing quarantined host overrides in pfsense",
+			slog.String("repaired", integration.ToUnsafeJSONString(repaired)),
+		)
+		s.recordDryRunDiff(ctx, original, section)
+		s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeSkipped, nil))
+		return repaired, nil
+	}
+
+	err = s.saveUnboundSection(ctx, section, fingerprint)
+	if errors.Is(err, errSectionChanged) {
+		return nil, integration.NewResourceConflictError(fmt.Sprintf("%s, repair the quarantined records again", errSectionChanged))
+	}
+	if err != nil {
+		s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeFailed, err))
+		return nil, fmt.Errorf("failed to save unbound section; %w", err)
+	}
+	s.audit.Record(ctx, s.auditEntries(ctx, changes, auditOutcomeApplied, nil))
+	slog.InfoContext(ctx, "repaired quarantined host overrides", slog.Int("count", len(repaired)))
+	return repaired, nil
+}
+
+// quarantined reports whether the record is a host override or a managed record of custom options that cannot
+// be read as a record.
+func (s *pfsenseService) quarantined(record unboundRecord) bool {
+	return record.readErr != nil
+}
+
+// verifyQuarantine refuses changes of names held by quarantined host overrides. They cannot be read,
+// so which record they hold is unknown and any change of the name, e.g. creating it again, would clash with them.
+func (s *pfsenseService) verifyQuarantine(records []unboundRecord, endpoints []UnboundEndpoint) error {
+	for _, record := range records {
+		if !s.quarantined(record) {
+			continue
+		}
+		if record.host == nil {
+			if err := s.verifyQuarantinedLocalData(record, endpoints); err != nil {
+				return err
+			}
+			continue
+		}
+		// the key is built from the host fields, it is all that is known of the record
+		dnsName, err := s.buildDNSName(record.host.Host, record.host.Domain)
+		if err != nil {
+			continue
+		}
+		key := UnboundEndpoint{DNSName: dnsName}.key()
+		for _, endpoint := range endpoints {
+			if endpoint.key().DNSName == key.DNSName {
+				return integration.NewResourceConflictError(fmt.Sprintf("dns name %s is held by a quarantined host override, repair it before changing the name", endpoint.DNSName))
+			}
+		}
+	}
+	return nil
+}
+
+// verifyQuarantinedLocalData refuses changes of names served by the local data of a quarantined record of custom
+// options. Wildcards are served from the apex of their zone, so the wildcard of a served name is held as well.
+func (s *pfsenseService) verifyQuarantinedLocalData(record unboundRecord, endpoints []UnboundEndpoint) error {
+	for _, line := range record.lines {
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "local-data:")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(strings.Trim(strings.TrimSpace(data), `"'`))
+		if len(fields) == 0 {
+			continue
+		}
+		key := UnboundEndpoint{DNSName: fields[0]}.key()
+		for _, endpoint := range endpoints {
+			if name := endpoint.key().DNSName; name == key.DNSName || name == "*."+key.DNSName {
+				return integration.NewResourceConflictError(fmt.Sprintf("dns name %s is held by a quarantined record of custom options, remove it from custom options before changing the name", endpoint.DNSName))
+			}
+		}
+	}
+	return nil
+}
+
+func (s *pfsenseService) toQuarantinedRecord(record unboundRecord) QuarantinedRecord {
+	if record.host == nil {
+		return QuarantinedRecord{
+			Record: strings.Join(record.lines, "\n"),
+			Reason: record.readErr.Error(),
+		}
+	}
+	return QuarantinedRecord{
+		Host:   record.host.Host,
+		Domain: record.host.Domain,
+		Ip:     record.host.Ip,
+		Descr:  record.host.Descr,
+		Reason: record.readErr.Error(),
+	}
+}
+
+// endpointFromHostFields builds the endpoint of a host override ignoring its description.
+func (s *pfsenseService) endpointFromHostFields(h host) (UnboundEndpoint, error) {
+	dnsName, err := s.buildDNSName(h.Host, h.Domain)
+	if err != nil {
+		return UnboundEndpoint{}, err
+	}
+	ips := s.splitHostIPs(h.Ip)
+	if len(ips) == 0 {
+		return UnboundEndpoint{}, fmt.Errorf("host %s has no ip address", dnsName)
+	}
+	recordType := s.addressRecordType(ips[0])
+	if slices.ContainsFunc(ips, func(ip string) bool { return s.addressRecordType(ip) != recordType }) {
+		return UnboundEndpoint{}, fmt.Errorf("host %s mixes ipv4 and ipv6 addresses, which cannot be a single A or AAAA record", dnsName)
+	}
+	for _, ip := range ips {
+		if err := s.validateAddress(recordType, ip); err != nil {
+			return UnboundEndpoint{}, fmt.Errorf("invalid ip of host %s; %w", dnsName, err)
+		}
+	}
+	return UnboundEndpoint{
+		DNSName:    dnsName,
+		Targets:    s.sortTargets(ips),
+		RecordType: recordType,
+	}, nil
+}
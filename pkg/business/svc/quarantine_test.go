@@ -0,0 +1,194 @@
+package svc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"github.com/stretchr/testify/require"
+)
+
+// appDescr is the description of app.example.com in the backup fixture
+const appDescr = "eyJ2ZXJzaW9uIjoxLCJvd25lcklkIjoiZGVmYXVsdCIsImNyZWF0ZWRBdCI6IjIwMjUtMDEtMTVUMDk6MzA6MDBaIiwidXBkYXRlZEF0IjoiMjAyNS0wMS0xNVQwOTozMDowMFoiLCJjaGVja3N1bSI6IjVmZDZkZjNiNWI5OTQwMTcxZjYxYTgyNDA1NzhmZDY4YjZkMTJjOTM5ZmVmMjgyN2IxMDY2Y2ViYjY0Yjc4ZGMiLCJlbmRwb2ludCI6eyJkbnNOYW1lIjoiYXBwLmV4YW1wbGUuY29tIiwidGFyZ2V0cyI6WyIxMC4wLjAuMTAiLCIxMC4wLjAuMTEiXSwicmVjb3JkVHlwZSI6IkEifX0="
+
+func Test_should_refuse_to_create_name_held_by_quarantined_host(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	corrupt := bytes.Replace(backup, []byte(appDescr), []byte("eyJkbnNOYW1lIjo="), 1)
+	pfsense := newFakePfsense(t, corrupt)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	// external-dns does not see the quarantined host, so it creates the name again
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{
+		{DNSName: "App.example.com", Targets: []string{"10.0.0.10"}, RecordType: recordTypeA},
+	}, nil, nil, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_not_quarantine_hand_made_description_that_is_valid_base64(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	// "home" decodes as base64, but not to a json object
+	handMade := bytes.Replace(backup, []byte("hand made &amp; kept"), []byte("home"), 1)
+	pfsense := newFakePfsense(t, handMade)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	quarantined, err := s.QuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, quarantined)
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, UnboundEndpoint{DNSName: "nas.home.arpa", Targets: []string{"192.168.1.5"}, RecordType: recordTypeA})
+
+	repaired, err := s.RepairQuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_quarantine_and_repair_host_with_corrupt_metadata(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	// the description of app.example.com is valid base64 but not a json endpoint anymore
+	corrupt := bytes.Replace(backup, []byte(appDescr), []byte("eyJkbnNOYW1lIjo="), 1)
+	pfsense := newFakePfsense(t, corrupt)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.NotEmpty(t, endpoints)
+	for _, endpoint := range endpoints {
+		require.NotEqual(t, "app.example.com", endpoint.DNSName)
+	}
+
+	quarantined, err := s.QuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "app", quarantined[0].Host)
+
+	repaired, err := s.RepairQuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Len(t, repaired, 1)
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	require.NotEqual(t, unboundValue(t, corrupt), unboundValue(t, restores[0]))
+	// the repaired metadata is rebuilt from the host fields, which is exactly what the fixture had
+	endpoint, _, err := s.decodeMetadata(hostDescr(t, restores[0], "app"))
+	require.NoError(t, err)
+	require.Equal(t, UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA}, endpoint)
+}
+
+func Test_should_quarantine_hand_made_host_with_mixed_addresses(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	mixed := bytes.Replace(backup, []byte("<string>192.168.1.5</string>"), []byte("<string>192.168.1.5,fd00::5</string>"), 1)
+	pfsense := newFakePfsense(t, mixed)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.NotEmpty(t, endpoints)
+	for _, endpoint := range endpoints {
+		require.NotEqual(t, "nas.home.arpa", endpoint.DNSName)
+	}
+
+	quarantined, err := s.QuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "nas", quarantined[0].Host)
+	require.Contains(t, quarantined[0].Reason, "mixes ipv4 and ipv6 addresses")
+
+	// mixed addresses cannot be repaired into a single record, so the host is left to be fixed in pfsense
+	repaired, err := s.RepairQuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Empty(t, pfsense.restores())
+}
+
+func Test_should_quarantine_unreadable_record_of_custom_options(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	s := newTestService(t, nil, PfsenseOptions{})
+	raw := customOptionsOf(t, backup)
+	text := s.decodeCustomOptions(raw)
+	// the metadata of www.example.com as if it was written as `{}` by an older version and kept its local data
+	metadata := regexp.MustCompile(`# record: \S+`).FindString(text)
+	require.NotEmpty(t, metadata)
+	corrupt := bytes.Replace(backup, []byte(raw), []byte(base64.StdEncoding.EncodeToString([]byte(strings.Replace(text, metadata, "# record: e30=", 1)))), 1)
+	pfsense := newFakePfsense(t, corrupt)
+	s = newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	require.Contains(t, endpoints, UnboundEndpoint{DNSName: "app.example.com", Targets: []string{"10.0.0.10", "10.0.0.11"}, RecordType: recordTypeA})
+	for _, endpoint := range endpoints {
+		require.NotEqual(t, "www.example.com", endpoint.DNSName)
+	}
+
+	quarantined, err := s.QuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "# record: e30=\nlocal-data: \"www.example.com. IN CNAME app.example.com.\"", quarantined[0].Record)
+	require.Contains(t, quarantined[0].Reason, "has no dns name")
+
+	// the name served by the quarantined record stays taken
+	err = s.ApplyChanges(t.Context(), []UnboundEndpoint{
+		{DNSName: "www.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME},
+	}, nil, nil, nil)
+	require.True(t, integration.IsResourceConflictError(err), err)
+
+	// other records are still changed, the quarantined one is written back as it was
+	require.NoError(t, s.ApplyChanges(t.Context(), []UnboundEndpoint{
+		{DNSName: "docs.example.com", Targets: []string{"app.example.com"}, RecordType: recordTypeCNAME},
+	}, nil, nil, nil))
+	restores := pfsense.restores()
+	require.Len(t, restores, 1)
+	written := s.decodeCustomOptions(customOptionsOf(t, restores[0]))
+	require.Contains(t, written, "# record: e30=\nlocal-data: \"www.example.com. IN CNAME app.example.com.\"\n")
+	require.Contains(t, written, "local-data: \"docs.example.com. IN CNAME app.example.com.\"")
+
+	repaired, err := s.RepairQuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Empty(t, repaired)
+	require.Len(t, pfsense.restores(), 1)
+}
+
+func Test_should_quarantine_host_renamed_outside_of_webhook(t *testing.T) {
+	t.Parallel()
+
+	backup, err := os.ReadFile("testdata/backup_config_section.xml")
+	require.NoError(t, err)
+	// the checksum still matches, but the metadata belongs to app.example.com
+	renamed := bytes.Replace(backup, []byte("<name>host</name><value><string>app</string>"), []byte("<name>host</name><value><string>api</string>"), 1)
+	pfsense := newFakePfsense(t, renamed)
+	s := newTestService(t, pfsense.client, PfsenseOptions{})
+
+	endpoints, err := s.ListEndpoints(t.Context())
+	require.NoError(t, err)
+	for _, endpoint := range endpoints {
+		require.NotEqual(t, "api.example.com", endpoint.DNSName)
+		require.NotEqual(t, "app.example.com", endpoint.DNSName)
+	}
+
+	quarantined, err := s.QuarantinedRecords(t.Context())
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	require.Equal(t, "api", quarantined[0].Host)
+	require.Contains(t, quarantined[0].Reason, "belongs to app.example.com")
+}
@@ -0,0 +1,119 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	safetyLimitMaxDeletions     = "maxDeletions"
+	safetyLimitMaxChangePercent = "maxChangePercent"
+	safetyLimitProtectedNames   = "protectedNames"
+)
+
+// SafetyLimits guard pfsense against change batches that touch too much at once, e.g. when a misconfigured
+// external-dns wants to delete every record. A zero limit is disabled.
+type SafetyLimits struct {
+	// MaxDeletions is the maximum number of records deleted by a single batch
+	MaxDeletions int
+	// MaxChangePercent is the maximum share of existing managed records updated or deleted by a single batch
+	MaxChangePercent int
+	// ProtectedNames are dns names or path.Match patterns, e.g. `*.example.com`, that are never changed
+	ProtectedNames []string
+}
+
+func (l SafetyLimits) validate() error {
+	if l.MaxDeletions < 0 {
+		return fmt.Errorf("max deletions should not be negative, got %+v", l.MaxDeletions)
+	}
+	if l.MaxChangePercent < 0 || l.MaxChangePercent > 100 {
+		return fmt.Errorf("max change percent should be within [0 100], got %+v", l.MaxChangePercent)
+	}
+	for _, pattern := range l.ProtectedNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("protected name %+v is not a valid pattern; %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// safetyLimitError refuses a batch that exceeds a safety limit; it is a policy violation that knows the limit.
+type safetyLimitError struct {
+	limit     string
+	violation string
+	err       *integration.PolicyViolationError
+}
+
+func (e *safetyLimitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *safetyLimitError) Unwrap() error {
+	return e.err
+}
+
+// verifySafetyLimits refuses the whole batch when it exceeds any of the limits, so nothing is written.
+// The refusal is not recorded here, since a plan runs the very same check; see recordSafetyViolation.
+func (s *pfsenseService) verifySafetyLimits(records []unboundRecord, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) error {
+	limit, violation := s.findSafetyViolation(records, toCreate, toUpdateOld, toUpdate, toDelete)
+	if violation == "" {
+		return nil
+	}
+	return &safetyLimitError{
+		limit:     limit,
+		violation: violation,
+		err:       integration.NewPolicyViolationError(fmt.Sprintf("changes exceed safety limit %s: %s; nothing was applied", limit, violation)),
+	}
+}
+
+// recordSafetyViolation counts and logs a batch that was refused by a safety limit.
+func (s *pfsenseService) recordSafetyViolation(ctx context.Context, err error) {
+	var limitErr *safetyLimitError
+	if !errors.As(err, &limitErr) {
+		return
+	}
+	safetyLimitViolations.Add(ctx, 1, metric.WithAttributes(attribute.String("limit", limitErr.limit)))
+	slog.WarnContext(ctx, "refusing changes that exceed safety limit", slog.String("limit", limitErr.limit), slog.String("violation", limitErr.violation))
+}
+
+func (s *pfsenseService) findSafetyViolation(records []unboundRecord, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (string, string) {
+	// a renamed record is changed under its old name as well
+	for _, endpoint := range slices.Concat(toCreate, toUpdateOld, toUpdate, toDelete) {
+		if pattern, ok := s.protectedBy(endpoint.DNSName); ok {
+			return safetyLimitProtectedNames, fmt.Sprintf("dns name %s is protected by %+v", endpoint.DNSName, pattern)
+		}
+	}
+
+	if s.safetyLimits.MaxDeletions > 0 && len(toDelete) > s.safetyLimits.MaxDeletions {
+		return safetyLimitMaxDeletions, fmt.Sprintf("%d records requested for deletion, at most %d allowed", len(toDelete), s.safetyLimits.MaxDeletions)
+	}
+
+	if s.safetyLimits.MaxChangePercent > 0 {
+		managed := len(integration.FilterSlice(records, s.exposed))
+		changed := len(toUpdate) + len(toDelete)
+		// creations do not touch existing records, so an initial sync into an empty pfsense is never refused
+		if managed > 0 && changed*100 > managed*s.safetyLimits.MaxChangePercent {
+			return safetyLimitMaxChangePercent, fmt.Sprintf("%d of %d managed records requested for update or deletion, at most %d%% allowed", changed, managed, s.safetyLimits.MaxChangePercent)
+		}
+	}
+	return "", ""
+}
+
+func (s *pfsenseService) protectedBy(dnsName string) (string, bool) {
+	name := strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	for _, pattern := range s.safetyLimits.ProtectedNames {
+		if matched, _ := path.Match(strings.ToLower(strings.TrimSuffix(pattern, ".")), name); matched {
+			return pattern, true
+		}
+	}
+	return "", false
+}
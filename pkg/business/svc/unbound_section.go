@@ -0,0 +1,157 @@
+package svc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+)
+
+const (
+	unboundHostsKey           = "hosts"
+	unboundCustomOptionsKey   = "custom_options"
+	unboundDomainOverridesKey = "domainoverrides"
+)
+
+// unbound is the unbound config section as pfsense returns it. The section is kept as a generic tree
+// of members in their original order, so elements the webhook does not model (domain overrides, acls,
+// host aliases, options of newer pfsense versions) are written back exactly as they were fetched.
+type unbound struct {
+	*integration.XMLRPCStruct
+}
+
+// fingerprint identifies the content of the section, it changes whenever any element of the section changes.
+func (u unbound) fingerprint() string {
+	// members are marshalled in their order, so the same content always gives the same fingerprint
+	content, _ := json.Marshal(u.XMLRPCStruct)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// clone copies the section so the copy is not affected by setHosts and setCustomOptions of the original.
+func (u unbound) clone() unbound {
+	// the setters replace the top-level members and never modify them in place, so a shallow copy is enough
+	return unbound{u.Clone()}
+}
+
+func (u unbound) hosts() ([]host, error) {
+	value, _ := u.Get(unboundHostsKey)
+	switch value := value.(type) {
+	case nil, string:
+		// pfsense returns an empty element as an empty string
+		return nil, nil
+	case *integration.XMLRPCStruct:
+		return []host{hostFromStruct(value)}, nil
+	case []any:
+		hosts := make([]host, 0, len(value))
+		for _, item := range value {
+			hostStruct, ok := item.(*integration.XMLRPCStruct)
+			if !ok {
+				return nil, fmt.Errorf("host override should be a struct, got %T", item)
+			}
+			hosts = append(hosts, hostFromStruct(hostStruct))
+		}
+		return hosts, nil
+	default:
+		return nil, fmt.Errorf("host overrides should be an array, got %T", value)
+	}
+}
+
+// domainOverrides returns the domains forwarded to other resolvers; the webhook only reads them.
+func (u unbound) domainOverrides() ([]string, error) {
+	value, _ := u.Get(unboundDomainOverridesKey)
+	var items []any
+	switch value := value.(type) {
+	case nil, string:
+		return nil, nil
+	case *integration.XMLRPCStruct:
+		items = []any{value}
+	case []any:
+		items = value
+	default:
+		return nil, fmt.Errorf("domain overrides should be an array, got %T", value)
+	}
+	domains := make([]string, 0, len(items))
+	for _, item := range items {
+		override, ok := item.(*integration.XMLRPCStruct)
+		if !ok {
+			return nil, fmt.Errorf("domain override should be a struct, got %T", item)
+		}
+		domain, _ := override.Get("domain")
+		if domain, ok := domain.(string); ok {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+func (u unbound) setHosts(hosts []host) {
+	if len(hosts) == 0 {
+		// drop the list the same way pfsense drops empty elements, but keep an element that was empty already
+		if value, _ := u.Get(unboundHostsKey); value != nil {
+			if _, ok := value.(string); !ok {
+				u.Delete(unboundHostsKey)
+			}
+		}
+		return
+	}
+	u.Set(unboundHostsKey, integration.MapSlice(hosts, func(h host) any {
+		return h.toStruct()
+	}))
+}
+
+func (u unbound) customOptions() string {
+	value, _ := u.Get(unboundCustomOptionsKey)
+	options, _ := value.(string)
+	return options
+}
+
+func (u unbound) setCustomOptions(options string) {
+	if _, ok := u.Get(unboundCustomOptionsKey); !ok && options == "" {
+		return
+	}
+	u.Set(unboundCustomOptionsKey, options)
+}
+
+//nolint:revive,staticcheck
+type host struct {
+	Host   string
+	Domain string
+	Ip     string
+	Descr  string
+	// raw is the host override as it is stored in pfsense, including the elements the webhook does not model
+	raw *integration.XMLRPCStruct
+}
+
+func hostFromStruct(s *integration.XMLRPCStruct) host {
+	value := func(key string) string {
+		v, _ := s.Get(key)
+		text, _ := v.(string)
+		return text
+	}
+	return host{
+		Host:   value("host"),
+		Domain: value("domain"),
+		Ip:     value("ip"),
+		Descr:  value("descr"),
+		raw:    s,
+	}
+}
+
+// toStruct returns the host override with the modelled fields replaced in place, so the members keep their order.
+func (h host) toStruct() *integration.XMLRPCStruct {
+	if h.raw == nil {
+		// pfsense expects every host override to have the aliases element
+		h.raw = &integration.XMLRPCStruct{Members: []integration.XMLRPCMember{
+			{Name: "host"}, {Name: "domain"}, {Name: "ip"}, {Name: "descr"}, {Name: "aliases", Value: ""},
+		}}
+	}
+	s := h.raw.Clone()
+	s.Set("host", h.Host)
+	s.Set("domain", h.Domain)
+	s.Set("ip", h.Ip)
+	s.Set("descr", h.Descr)
+	return s
+}
@@ -0,0 +1,124 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/slamdev/external-dns-pfsense-webhook/pkg/integration"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// validationModeStrict refuses the whole batch when any endpoint is invalid
+	validationModeStrict = "strict"
+	// validationModeLenient skips invalid endpoints and applies the rest of the batch
+	validationModeLenient = "lenient"
+)
+
+// SkippedEndpoint is an invalid endpoint that lenient validation leaves out of a batch.
+type SkippedEndpoint struct {
+	// Name points at the endpoint in the batch, e.g. `create[0]`
+	Name     string
+	Endpoint UnboundEndpoint
+	Reason   string
+}
+
+// verifyEndpoints checks the endpoints like checkEndpoints does, counts the invalid ones and logs the skipped ones,
+// which are returned as the skipped error.
+func (s *pfsenseService) verifyEndpoints(ctx context.Context, filters []string, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (changeSet, *integration.ValidationError, error) {
+	valid, skipped, err := s.checkEndpoints(filters, toCreate, toUpdateOld, toUpdate, toDelete)
+	invalid := len(skipped)
+	var refused *integration.ValidationError
+	if errors.As(err, &refused) {
+		invalid = len(refused.Params())
+	}
+	if invalid > 0 {
+		invalidEndpoints.Add(ctx, int64(invalid), metric.WithAttributes(attribute.String("mode", s.validationMode)))
+	}
+	if err != nil || len(skipped) == 0 {
+		return valid, nil, err
+	}
+
+	skippedErr := integration.NewValidationErrorWithParams(fmt.Sprintf("%d endpoints are invalid and were skipped, the valid changes are applied; %s", len(skipped), skipped[0].Reason), s.invalidParams(skipped))
+	slog.WarnContext(ctx, "skipping invalid endpoints, applying the valid ones",
+		slog.Any("problem", integration.NewProblemDetail(ctx, http.StatusBadRequest, skippedErr)),
+	)
+	return valid, skippedErr, nil
+}
+
+// checkEndpoints checks the endpoints that do not depend on the state of pfsense against the resolved domain
+// filters and returns the valid ones. In strict validation mode any invalid endpoint refuses the whole batch; in lenient
+// mode invalid endpoints are skipped and returned, so the valid changes of the same batch are still applied and the
+// invalid endpoints are reported afterwards. Nothing is recorded, so a plan can run it as well.
+func (s *pfsenseService) checkEndpoints(filters []string, toCreate []UnboundEndpoint, toUpdateOld []UnboundEndpoint, toUpdate []UnboundEndpoint, toDelete []UnboundEndpoint) (valid changeSet, skipped []SkippedEndpoint, err error) {
+	if len(toUpdateOld) > 0 && len(toUpdateOld) != len(toUpdate) {
+		return changeSet{}, nil, integration.NewValidationError(fmt.Sprintf("every update should be paired with its old record, got %d old and %d new records", len(toUpdateOld), len(toUpdate)))
+	}
+	var invalid []SkippedEndpoint
+	for i, endpoint := range toCreate {
+		if reason := s.rejectionReason(endpoint, filters); reason != "" {
+			invalid = append(invalid, SkippedEndpoint{Name: fmt.Sprintf("create[%d]", i), Endpoint: endpoint, Reason: reason})
+			continue
+		}
+		valid.toCreate = append(valid.toCreate, endpoint)
+	}
+	for i, endpoint := range toUpdate {
+		// an update is skipped together with its old record, so the pairs stay aligned
+		if reason := s.rejectionReason(endpoint, filters); reason != "" {
+			invalid = append(invalid, SkippedEndpoint{Name: fmt.Sprintf("updateNew[%d]", i), Endpoint: endpoint, Reason: reason})
+			continue
+		}
+		if len(toUpdateOld) > 0 {
+			if reason := s.scopeReason(toUpdateOld[i].DNSName, filters); reason != "" {
+				invalid = append(invalid, SkippedEndpoint{Name: fmt.Sprintf("updateOld[%d]", i), Endpoint: toUpdateOld[i], Reason: reason})
+				continue
+			}
+			valid.toUpdateOld = append(valid.toUpdateOld, toUpdateOld[i])
+		}
+		valid.toUpdate = append(valid.toUpdate, endpoint)
+	}
+	for i, endpoint := range toDelete {
+		if reason := s.scopeReason(endpoint.DNSName, filters); reason != "" {
+			invalid = append(invalid, SkippedEndpoint{Name: fmt.Sprintf("delete[%d]", i), Endpoint: endpoint, Reason: reason})
+			continue
+		}
+		valid.toDelete = append(valid.toDelete, endpoint)
+	}
+	if len(invalid) > 0 && s.validationMode != validationModeLenient {
+		return changeSet{}, nil, integration.NewValidationErrorWithParams(fmt.Sprintf("%d endpoints are invalid; %s", len(invalid), invalid[0].Reason), s.invalidParams(invalid))
+	}
+	return valid, invalid, nil
+}
+
+func (s *pfsenseService) invalidParams(endpoints []SkippedEndpoint) []integration.InvalidParam {
+	return integration.MapSlice(endpoints, func(endpoint SkippedEndpoint) integration.InvalidParam {
+		return integration.InvalidParam{Name: endpoint.Name, Reason: endpoint.Reason}
+	})
+}
+
+// scopeReason returns why the dns name is not managed by the webhook, or an empty string when it is.
+func (s *pfsenseService) scopeReason(dnsName string, filters []string) string {
+	if !s.namePolicy.Allows(dnsName) {
+		return fmt.Sprintf("dns name %s is not allowed by the name policy", dnsName)
+	}
+	if !s.inDomainFilters(dnsName, filters) {
+		return fmt.Sprintf("dns name %s is outside of domain filters %+v", dnsName, filters)
+	}
+	return ""
+}
+
+// changeSet holds the changes of a batch that passed validation.
+type changeSet struct {
+	toCreate    []UnboundEndpoint
+	toUpdateOld []UnboundEndpoint
+	toUpdate    []UnboundEndpoint
+	toDelete    []UnboundEndpoint
+}
+
+func (c changeSet) empty() bool {
+	return len(c.toCreate) == 0 && len(c.toUpdate) == 0 && len(c.toDelete) == 0
+}
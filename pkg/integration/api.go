@@ -2,6 +2,7 @@ package integration
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 
@@ -47,16 +48,19 @@ func APIHandler(mux *http.ServeMux) http.Handler {
 }
 
 func createAndRecordProblemDetail(ctx context.Context, status int, err error) ProblemDetailV1 {
-	title := http.StatusText(status)
 	span := trace.SpanFromContext(ctx)
-	var traceID string
-	if span.SpanContext().HasTraceID() {
-		traceID = span.SpanContext().TraceID().String()
-	}
 	if err != nil {
 		span.RecordError(err)
 	}
-	span.SetStatus(codes.Error, title)
+	span.SetStatus(codes.Error, http.StatusText(status))
+	return NewProblemDetail(ctx, status, err)
+}
+
+// NewProblemDetail describes the error without recording it on the span, e.g. to log a failure
+// that does not fail the request.
+func NewProblemDetail(ctx context.Context, status int, err error) ProblemDetailV1 {
+	title := http.StatusText(status)
+	traceID := TraceID(ctx)
 	requestURI, _ := ctx.Value(RequestURIKey{}).(string)
 
 	errText := title
@@ -64,13 +68,20 @@ func createAndRecordProblemDetail(ctx context.Context, status int, err error) Pr
 		errText = fmt.Sprintf("%+v", err)
 	}
 
+	var invalidParams []InvalidParam
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		invalidParams = validationErr.Params()
+	}
+
 	return ProblemDetailV1{
-		Instance: requestURI,
-		Status:   status,
-		Title:    title,
-		TraceID:  traceID,
-		Type:     "about:blank",
-		Detail:   errText,
+		Instance:      requestURI,
+		Status:        status,
+		Title:         title,
+		TraceID:       traceID,
+		Type:          "about:blank",
+		Detail:        errText,
+		InvalidParams: invalidParams,
 	}
 }
 
@@ -85,4 +96,11 @@ type ProblemDetailV1 struct {
 	Title    string `json:"title"`
 	TraceID  string `json:"traceId"`
 	Type     string `json:"type"`
+	// InvalidParams lists every invalid part of the request, see https://www.rfc-editor.org/rfc/rfc9457#section-3
+	InvalidParams []InvalidParam `json:"invalidParams,omitempty"`
+}
+
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
 }
@@ -7,17 +7,27 @@ import (
 )
 
 type ValidationError struct {
-	err string
+	err    string
+	params []InvalidParam
 }
 
 func (e *ValidationError) Error() string {
 	return e.err
 }
 
+// Params are the invalid parts of the request, reported one by one in the problem detail.
+func (e *ValidationError) Params() []InvalidParam {
+	return e.params
+}
+
 func NewValidationError(err string) *ValidationError {
 	return &ValidationError{err: err}
 }
 
+func NewValidationErrorWithParams(err string, params []InvalidParam) *ValidationError {
+	return &ValidationError{err: err, params: params}
+}
+
 func IsValidationError(err error) bool {
 	var base *ValidationError
 	return errors.As(err, &base)
@@ -74,6 +84,23 @@ func IsAccessDeniedError(err error) bool {
 	return errors.As(err, &base)
 }
 
+type PolicyViolationError struct {
+	err string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return e.err
+}
+
+func NewPolicyViolationError(err string) *PolicyViolationError {
+	return &PolicyViolationError{err: err}
+}
+
+func IsPolicyViolationError(err error) bool {
+	var base *PolicyViolationError
+	return errors.As(err, &base)
+}
+
 func CatchPanic(f func() error) (err error) {
 	defer func() {
 		rec := recover()
@@ -116,6 +116,10 @@ func HandleHTTPCommonError(w http.ResponseWriter, r *http.Request, err error) {
 		HandleHTTPForbidden(w, r, err)
 		return
 	}
+	if IsPolicyViolationError(err) {
+		HandleHTTPUnprocessableEntity(w, r, err)
+		return
+	}
 	HandleHTTPServerError(w, r, err)
 }
 
@@ -6,62 +6,27 @@ import (
 	"encoding/base64"
 	"fmt"
 
-	"alexejk.io/go-xmlrpc"
 	"github.com/alexliesenfeld/health"
 )
 
-func CreatePfsenseClient(url string, username string, password string, insecure bool) (*xmlrpc.Client, error) {
+func CreatePfsenseClient(url string, username string, password string, insecure bool) *XMLRPCClient {
 	//nolint:gosec
 	httpClient := NewHTTPClientWithTLS("pfsense", &tls.Config{InsecureSkipVerify: insecure})
 	headers := map[string]string{
 		"Authorization": "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
 	}
 	url += "/xmlrpc.php"
-	c, err := xmlrpc.NewClient(url, xmlrpc.HttpClient(httpClient), xmlrpc.Headers(headers))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create xmlrpc client; %w", err)
-	}
-	return c, nil
+	return NewXMLRPCClient(url, httpClient, headers)
 }
 
-func PfsenseHealthCheck(client *xmlrpc.Client) health.Check {
+func PfsenseHealthCheck(client *XMLRPCClient) health.Check {
 	return health.Check{
 		Name: "pfsense",
-		Check: func(_ context.Context) error {
-			req := &struct {
-				Dummy   string
-				Timeout int
-			}{
-				Dummy:   "dummy_value",
-				Timeout: 30,
-			}
-			res := &NestedXMLRPC[hostFirmwareVersionResponse]{}
-			if err := client.Call("pfsense.host_firmware_version", req, res); err != nil {
+		Check: func(ctx context.Context) error {
+			if _, err := client.Call(ctx, "pfsense.host_firmware_version", "dummy_value", 30); err != nil {
 				return fmt.Errorf("failed to make rpc call; %w", err)
 			}
 			return nil
 		},
 	}
 }
-
-type NestedXMLRPC[T any] struct {
-	Nested T
-}
-
-type hostFirmwareVersionResponse struct {
-	Firmware struct {
-		Version string
-	}
-	Kernel struct {
-		Version string
-	}
-	Base struct {
-		Version string
-	}
-	Platform      string
-	ConfigVersion string
-}
-
-type OperationResult struct {
-	Success bool
-}
@@ -143,9 +143,13 @@ func ConfigureLogProvider(_ *resource.Resource, level string, format string) {
 	otel.SetLogger(logr.FromSlogHandler(l.Handler()))
 }
 
-func TelemetryHandler(healthChecker health.Checker) http.Handler {
+// TelemetryHandler serves health and metrics endpoints together with the additional handlers keyed by their patterns.
+func TelemetryHandler(healthChecker health.Checker, handlers map[string]http.Handler) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", HandleHTTPNotFound)
+	for pattern, handler := range handlers {
+		mux.Handle(pattern, handler)
+	}
 	mux.Handle("/metrics", PrometheusHandler())
 	mux.HandleFunc("/live", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
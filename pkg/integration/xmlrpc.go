@@ -0,0 +1,351 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// XMLRPCStruct is an xml-rpc struct that keeps its members in the order they were received,
+// so a value that is sent back unchanged is encoded exactly as it was fetched.
+type XMLRPCStruct struct {
+	Members []XMLRPCMember
+}
+
+// XMLRPCMember is a member of an xml-rpc struct, its value is nil when the member has no value element.
+type XMLRPCMember struct {
+	Name  string
+	Value any
+}
+
+// XMLRPCScalar is a scalar the client does not interpret, e.g. an int or a date; it is encoded back with its type.
+type XMLRPCScalar struct {
+	Type string
+	Text string
+}
+
+func (s *XMLRPCStruct) Get(name string) (any, bool) {
+	for _, member := range s.Members {
+		if member.Name == name {
+			return member.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the value of the member in place or appends the member when there is none.
+func (s *XMLRPCStruct) Set(name string, value any) {
+	for i, member := range s.Members {
+		if member.Name == name {
+			s.Members[i].Value = value
+			return
+		}
+	}
+	s.Members = append(s.Members, XMLRPCMember{Name: name, Value: value})
+}
+
+func (s *XMLRPCStruct) Delete(name string) {
+	members := make([]XMLRPCMember, 0, len(s.Members))
+	for _, member := range s.Members {
+		if member.Name != name {
+			members = append(members, member)
+		}
+	}
+	s.Members = members
+}
+
+// Clone copies the list of members; the values are shared, so they have to be replaced rather than changed in place.
+func (s *XMLRPCStruct) Clone() *XMLRPCStruct {
+	members := make([]XMLRPCMember, len(s.Members))
+	copy(members, s.Members)
+	return &XMLRPCStruct{Members: members}
+}
+
+type XMLRPCClient struct {
+	url        string
+	httpClient *http.Client
+	headers    map[string]string
+}
+
+func NewXMLRPCClient(url string, httpClient *http.Client, headers map[string]string) *XMLRPCClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &XMLRPCClient{url: url, httpClient: httpClient, headers: headers}
+}
+
+// Call invokes the method and returns the params of the response. Params can be strings, booleans, ints,
+// string slices, []any arrays, *XMLRPCStruct and XMLRPCScalar; response structs are decoded to *XMLRPCStruct,
+// arrays to []any, strings and booleans to their go types and the rest of scalars to XMLRPCScalar.
+func (c *XMLRPCClient) Call(ctx context.Context, method string, params ...any) ([]any, error) {
+	body, err := encodeXMLRPCCall(method, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s call; %w", method, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s request; %w", method, err)
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	for name, value := range c.headers {
+		req.Header.Set(name, value)
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call %s; %w", method, err)
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s call returned %s", method, res.Status)
+	}
+	values, err := decodeXMLRPCResponse(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s response; %w", method, err)
+	}
+	return values, nil
+}
+
+// IsXMLRPCSuccess reports whether the response is a single `true`, which is how pfsense reports a successful call.
+func IsXMLRPCSuccess(params []any) bool {
+	if len(params) == 0 {
+		return false
+	}
+	success, ok := params[0].(bool)
+	return ok && success
+}
+
+// XMLEscaper escapes the markup characters only, the same way pfsense encodes its responses and config.xml;
+// quotes are left as they are
+var XMLEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func encodeXMLRPCCall(method string, params []any) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n<methodCall><methodName>")
+	b.WriteString(XMLEscaper.Replace(method))
+	b.WriteString("</methodName><params>")
+	for _, param := range params {
+		b.WriteString("<param>")
+		if err := encodeXMLRPCValue(&b, param); err != nil {
+			return nil, err
+		}
+		b.WriteString("</param>")
+	}
+	b.WriteString("</params></methodCall>")
+	return b.Bytes(), nil
+}
+
+func encodeXMLRPCValue(b *bytes.Buffer, value any) error {
+	if items, ok := value.([]string); ok {
+		value = MapSlice(items, func(item string) any { return item })
+	}
+	b.WriteString("<value>")
+	switch v := value.(type) {
+	case string:
+		b.WriteString("<string>" + XMLEscaper.Replace(v) + "</string>")
+	case bool:
+		b.WriteString("<boolean>" + map[bool]string{true: "1", false: "0"}[v] + "</boolean>")
+	case int:
+		b.WriteString("<int>" + strconv.Itoa(v) + "</int>")
+	case []any:
+		b.WriteString("<array><data>")
+		for _, item := range v {
+			if err := encodeXMLRPCValue(b, item); err != nil {
+				return err
+			}
+		}
+		b.WriteString("</data></array>")
+	case *XMLRPCStruct:
+		b.WriteString("<struct>")
+		for _, member := range v.Members {
+			b.WriteString("<member><name>" + XMLEscaper.Replace(member.Name) + "</name>")
+			// a member that came without a value is sent back without one
+			if member.Value != nil {
+				if err := encodeXMLRPCValue(b, member.Value); err != nil {
+					return err
+				}
+			}
+			b.WriteString("</member>")
+		}
+		b.WriteString("</struct>")
+	case XMLRPCScalar:
+		b.WriteString("<" + v.Type + ">" + XMLEscaper.Replace(v.Text) + "</" + v.Type + ">")
+	default:
+		return fmt.Errorf("xml-rpc value of type %T is not supported", value)
+	}
+	b.WriteString("</value>")
+	return nil
+}
+
+func decodeXMLRPCResponse(body io.Reader) ([]any, error) {
+	d := xml.NewDecoder(body)
+	var params []any
+	fault := false
+	for {
+		token, err := d.Token()
+		if errors.Is(err, io.EOF) {
+			return params, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "fault":
+			fault = true
+		case "value":
+			value, err := decodeXMLRPCValue(d)
+			if err != nil {
+				return nil, err
+			}
+			if fault {
+				return nil, xmlrpcFault(value)
+			}
+			params = append(params, value)
+		}
+	}
+}
+
+// decodeXMLRPCValue decodes the content of a value element whose start element is already read.
+func decodeXMLRPCValue(d *xml.Decoder) (any, error) {
+	var text strings.Builder
+	var value any
+	typed := false
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			text.Write(t)
+		case xml.StartElement:
+			if value, err = decodeXMLRPCTypedValue(d, t); err != nil {
+				return nil, err
+			}
+			typed = true
+		case xml.EndElement:
+			// a value without a type is a string
+			if !typed {
+				return text.String(), nil
+			}
+			return value, nil
+		}
+	}
+}
+
+func decodeXMLRPCTypedValue(d *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "struct":
+		s := &XMLRPCStruct{Members: []XMLRPCMember{}}
+		for {
+			token, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				if t.Name.Local != "member" {
+					if err := d.Skip(); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				member, err := decodeXMLRPCMember(d)
+				if err != nil {
+					return nil, err
+				}
+				s.Members = append(s.Members, member)
+			case xml.EndElement:
+				return s, nil
+			}
+		}
+	case "array":
+		values := []any{}
+		for {
+			token, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				// values are nested in the data element
+				if t.Name.Local != "value" {
+					continue
+				}
+				value, err := decodeXMLRPCValue(d)
+				if err != nil {
+					return nil, err
+				}
+				values = append(values, value)
+			case xml.EndElement:
+				if t.Name.Local == "array" {
+					return values, nil
+				}
+			}
+		}
+	default:
+		var text string
+		if err := d.DecodeElement(&text, &start); err != nil {
+			return nil, err
+		}
+		switch start.Name.Local {
+		case "string":
+			return text, nil
+		case "boolean":
+			return strings.TrimSpace(text) == "1", nil
+		default:
+			return XMLRPCScalar{Type: start.Name.Local, Text: text}, nil
+		}
+	}
+}
+
+func decodeXMLRPCMember(d *xml.Decoder) (XMLRPCMember, error) {
+	var member XMLRPCMember
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return XMLRPCMember{}, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "name":
+				if err := d.DecodeElement(&member.Name, &t); err != nil {
+					return XMLRPCMember{}, err
+				}
+			case "value":
+				if member.Value, err = decodeXMLRPCValue(d); err != nil {
+					return XMLRPCMember{}, err
+				}
+			default:
+				if err := d.Skip(); err != nil {
+					return XMLRPCMember{}, err
+				}
+			}
+		case xml.EndElement:
+			return member, nil
+		}
+	}
+}
+
+func xmlrpcFault(value any) error {
+	fault, ok := value.(*XMLRPCStruct)
+	if !ok {
+		return fmt.Errorf("xml-rpc fault %v", value)
+	}
+	code, _ := fault.Get("faultCode")
+	message, _ := fault.Get("faultString")
+	if scalar, ok := code.(XMLRPCScalar); ok {
+		code = scalar.Text
+	}
+	return fmt.Errorf("xml-rpc fault %v; %v", code, message)
+}
@@ -0,0 +1,94 @@
+package integration
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_should_round_trip_xmlrpc_values(t *testing.T) {
+	t.Parallel()
+
+	section := &XMLRPCStruct{Members: []XMLRPCMember{
+		{Name: "zeta", Value: "last & <first>"},
+		{Name: "alpha", Value: true},
+		{Name: "port", Value: XMLRPCScalar{Type: "int", Text: "53"}},
+		{Name: "hosts", Value: []any{
+			&XMLRPCStruct{Members: []XMLRPCMember{{Name: "host", Value: "app"}, {Name: "aliases", Value: ""}}},
+		}},
+		{Name: "empty", Value: &XMLRPCStruct{Members: []XMLRPCMember{}}},
+		{Name: "novalue"},
+	}}
+
+	body, err := encodeXMLRPCCall("pfsense.restore_config_section", []any{section, 30})
+	require.NoError(t, err)
+	require.Contains(t, string(body), "<string>last &amp; &lt;first&gt;</string>")
+	require.Contains(t, string(body), "<member><name>novalue</name></member>")
+
+	params, err := decodeXMLRPCResponse(bytes.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, []any{section, XMLRPCScalar{Type: "int", Text: "30"}}, params)
+
+	// the decoded values are encoded exactly as they were received
+	again, err := encodeXMLRPCCall("pfsense.restore_config_section", params)
+	require.NoError(t, err)
+	require.Equal(t, string(body), string(again))
+}
+
+func Test_should_keep_member_order(t *testing.T) {
+	t.Parallel()
+
+	params, err := decodeXMLRPCResponse(strings.NewReader(`<methodResponse><params><param><value><struct>
+<member><name>c</name><value>untyped</value></member>
+<member><name>a</name><value><string>1</string></value></member>
+<member><name>b</name><value><boolean>0</boolean></value></member>
+</struct></value></param></params></methodResponse>`))
+	require.NoError(t, err)
+	require.Len(t, params, 1)
+	s, ok := params[0].(*XMLRPCStruct)
+	require.True(t, ok)
+	require.Equal(t, []XMLRPCMember{{Name: "c", Value: "untyped"}, {Name: "a", Value: "1"}, {Name: "b", Value: false}}, s.Members)
+
+	// a replaced member stays in place, a new one goes last
+	s.Set("a", "2")
+	s.Set("d", "3")
+	s.Delete("c")
+	require.Equal(t, []string{"a", "b", "d"}, MapSlice(s.Members, func(member XMLRPCMember) string { return member.Name }))
+
+	clone := s.Clone()
+	clone.Set("a", "4")
+	value, _ := s.Get("a")
+	require.Equal(t, "2", value)
+}
+
+func Test_should_return_xmlrpc_faults_as_errors(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !bytes.Contains(body, []byte("<methodName>pfsense.exec_php</methodName>")) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`<?xml version="1.0"?><methodResponse><fault><value><struct>
+<member><name>faultCode</name><value><int>3</int></value></member>
+<member><name>faultString</name><value><string>Authentication failed</string></value></member>
+</struct></value></fault></methodResponse>`))
+	}))
+	t.Cleanup(server.Close)
+	client := NewXMLRPCClient(server.URL, server.Client(), nil)
+
+	_, err := client.Call(t.Context(), "pfsense.exec_php", "$toreturn = true;")
+	require.ErrorContains(t, err, "xml-rpc fault 3; Authentication failed")
+	_, err = client.Call(t.Context(), "pfsense.unknown")
+	require.ErrorContains(t, err, "404")
+
+	require.True(t, IsXMLRPCSuccess([]any{true}))
+	require.False(t, IsXMLRPCSuccess([]any{false}))
+	require.False(t, IsXMLRPCSuccess(nil))
+}
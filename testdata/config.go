@@ -12,6 +12,8 @@ type Config struct {
 	App struct {
 		URL       string
 		AutoStart bool
+		// DomainFilters are the domain filters the app is expected to advertise, the auto-started app is configured with them
+		DomainFilters []string
 	}
 	HTTPClientTimeout time.Duration
 }